@@ -23,21 +23,18 @@ var rootCmd = &cobra.Command{
 }
 
 // return whether there's something to read on stdin
-func getArgsFromStdin() ([]string, bool) {
+func getArgsFromStdin(flags infra.Flags) ([]string, bool, error) {
 
 	fi, _ := os.Stdin.Stat()
 
 	if (fi.Mode() & os.ModeCharDevice) == 0 {
 		//fmt.Println("reading from stdin")
 
-		bytes, _ := io.ReadAll(os.Stdin)
-		str := string(bytes)
-
-		// .Fields() breaks the input string into separate words.  That seems ok but maybe it's not quite right?
-		return strings.Fields(str), true
+		targets, err := infra.ReadTargets(os.Stdin, flags)
+		return targets, true, err
 	}
 
-	return nil, false
+	return nil, false, nil
 }
 
 // TODO this function does too much and needs to be broken out into testable bits.
@@ -46,23 +43,44 @@ func ConcurCmdE(cmd *cobra.Command, args []string) error {
 	var targets []string
 	var template string
 
-	stdinArgs, ok := getArgsFromStdin()
+	flags := infra.PopulateFlags(cmd)
+
+	if len(args) == 0 { // need at least a command to run
+		cmd.Help()
+		os.Exit(1)
+	}
+	template = args[0]
+
+	// cut stdin up and feed it to jobs instead of reading targets from it
+	if flags.Pipe {
+		cmd.SilenceUsage = true
+		res, err := infra.DoPipe(template, os.Stdin, flags)
+		if err != nil {
+			return err
+		}
+		infra.ReportDone(res, flags)
+		if res.Info.Interrupted {
+			os.Exit(infra.ExitInterrupted)
+		}
+		return nil
+	}
+
+	stdinArgs, ok, err := getArgsFromStdin(flags)
+	if err != nil {
+		return err
+	}
 
 	if ok {
 		targets = stdinArgs
-		template = args[0]
 	} else {
-		switch len(args) {
-		case 0, 1: // 0 == command name only, 1 == string to run in but nothing to sub into it
+		targets = args[1:]
+		// a template with nothing to sub into it is only ok if --list or --targets-file is giving us something
+		if len(targets) == 0 && len(flags.Lists) == 0 && flags.TargetsFile == "" {
 			cmd.Help()
 			os.Exit(1)
 		}
-		template = args[0]
-		targets = args[1:]
 	}
 
-	flags := infra.PopulateFlags(cmd)
-
 	/* logs are called like
 
 	slog.Info("hello slog info")
@@ -89,8 +107,17 @@ func ConcurCmdE(cmd *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
-	res := infra.Do(template, targets, flags)
+	// anything past here is a problem with the job rather than how concur was called
+	cmd.SilenceUsage = true
+
+	res, err := infra.Do(template, targets, flags)
+	if err != nil {
+		return err
+	}
 	infra.ReportDone(res, flags)
+	if res.Info.Interrupted {
+		os.Exit(infra.ExitInterrupted)
+	}
 	return nil
 }
 
@@ -108,11 +135,58 @@ func init() {
 
 	rootCmd.Flags().Bool("any", false, "Return any (the first) job with exit code of zero")
 	rootCmd.Flags().Bool("first", false, "First commanjobd regardless of exit code")
+	rootCmd.Flags().Bool("keep-running", false, "With --any or --first, let the other jobs finish instead of cancelling them; the winner is still reported first")
 
 	rootCmd.Flags().StringP("concurrent", "c", "128",
 		"Number of concurrent jobs (0 = no limit), 'cpu' or '1x' = one job per cpu core, '2x' = two jobs per cpu core")
 	rootCmd.Flags().StringP("timeout", "t", "0", "Global timeout in time.Duration format (0 default for no timeout)")
-	rootCmd.Flags().StringP("token", "", "{{1}}", "Token to match for replacement")
+	rootCmd.Flags().StringP("token", "", infra.DefaultToken, "Token to match for replacement")
+	rootCmd.Flags().StringP("template-engine", "", "simple", "Template engine, 'simple' for {{1}} substitution or 'go' for text/template")
+	rootCmd.Flags().BoolP("lines", "", false, "Read one target per line from stdin instead of splitting on whitespace")
+	rootCmd.Flags().BoolP("null", "0", false, "Read NUL separated targets from stdin, e.g. from find -print0")
+	rootCmd.Flags().StringP("delimiter", "d", "", "Read targets from stdin separated by this string")
+	rootCmd.Flags().BoolP("no-skip", "", false, "Keep blank and '#' comment entries from --lines, -0 and --delimiter input")
+	rootCmd.Flags().BoolP("expand", "e", false, "Expand CIDR blocks (10.0.0.0/28), numeric ranges (rtr[01-16]) and brace lists (edge-{a,b}) in targets")
+	rootCmd.Flags().IntP("expand-limit", "", 65536, "Most targets a single target may expand into with --expand (0 = no limit)")
+	rootCmd.Flags().BoolP("cidr-hosts", "", false, "Skip network and broadcast addresses when expanding IPv4 CIDR blocks")
+	rootCmd.Flags().StringP("targets-file", "", "", "Read targets from a CSV file (TSV if it ends in .tsv) whose header row names the columns for {{name}}")
+	rootCmd.Flags().StringArrayP("list", "", nil, "Named list of values, name=a,b,c or name=@file, for {{name}}; jobs run for every combination of lists (repeatable)")
+	rootCmd.Flags().BoolP("zip", "", false, "Pair --list values (and targets) up element by element instead of running every combination")
+	rootCmd.Flags().BoolP("zip-shortest", "", false, "Like --zip, but stop at the end of the shortest list instead of complaining about different lengths")
+	rootCmd.Flags().BoolP("unique", "", false, "Drop duplicate targets")
+	rootCmd.Flags().StringArrayP("exclude", "", nil, "Drop targets matching this; exact match, a glob like db*, or re:regex (repeatable)")
+	rootCmd.Flags().StringP("exclude-file", "", "", "Read more --exclude patterns from this file, one per line")
+	rootCmd.Flags().StringP("include-regex", "", "", "Only keep targets matching this regex")
+	rootCmd.Flags().IntP("max-args", "n", 0, "Pack up to this many targets into each command as {{@}}, like xargs -n (0 = one target per command)")
+	rootCmd.Flags().StringP("stdin-file", "", "", "Feed this file to every job on stdin")
+	rootCmd.Flags().StringP("stdin-template", "", "", "Per-job stdin rendered from the target; inline text, or @path to read a file, e.g. @configs/{{1}}.txt")
+	rootCmd.Flags().BoolP("pipe", "", false, "Split stdin into chunks and feed one chunk to each job on stdin instead of reading targets")
+	rootCmd.Flags().StringP("block", "", "1M", "Size of --pipe chunks, e.g. 512K, 10M")
+	rootCmd.Flags().StringP("recend", "", "", "Record separator --pipe chunks are split on, \\n style escapes allowed (default newline)")
+	rootCmd.Flags().StringP("reassemble", "", "", "Write the stdout of --pipe jobs to this file in chunk order")
+	rootCmd.Flags().StringArrayP("env", "", nil, "Set KEY=template in each job's environment, rendered from the target like the command (repeatable)")
+	rootCmd.Flags().StringP("env-file", "", "", "Read more KEY=template environment settings from this file, one per line")
+	rootCmd.Flags().BoolP("clean-env", "", false, "Start jobs with an empty environment instead of concur's")
+	rootCmd.Flags().BoolP("record-env", "", false, "Save each job's environment in the JSON, with anything that looks secret redacted")
+	rootCmd.Flags().StringP("workdir", "", "", "Run each job in this directory, rendered from the target like the command and created if it doesn't exist")
+	rootCmd.Flags().BoolP("keep-tmp", "", false, "Keep each job's {{tmpdir}} scratch directory instead of removing it when the job succeeds")
+	rootCmd.Flags().StringP("kill-signal", "", "TERM", "Signal sent to a job's whole process group when it times out or the run is cancelled")
+	rootCmd.Flags().StringP("kill-grace", "", infra.DefaultKillGrace.String(), "How long a job gets after --kill-signal before it's sent SIGKILL")
+	rootCmd.Flags().IntP("retries", "", 0, "Run failed jobs up to this many more times")
+	rootCmd.Flags().StringP("retry-delay", "", infra.DefaultRetryDelay.String(), "Wait about this long before the first retry, doubling for each one after that")
+	rootCmd.Flags().StringArrayP("retry-on", "", nil, "Only retry jobs failing like this: an exit code, Errored, TimedOut, or stderr:regex (repeatable, default any failure)")
+	rootCmd.Flags().StringP("max-output", "", "0", "Keep at most this much of each job's stdout and stderr, the first and last halves, e.g. 64K (0 = all of it)")
+	rootCmd.Flags().StringP("max-output-total", "", "0", "Most output all jobs can hold in memory between them before it's truncated too, e.g. 1G (0 = no limit)")
+	rootCmd.Flags().StringP("spill", "", "0", "Write a job's stdout or stderr to a file instead of keeping it in memory once it's bigger than this, e.g. 1M (0 = never)")
+	rootCmd.Flags().StringP("results-dir", "", "", "Where spilled output goes as <job id>.stdout and <job id>.stderr (default a new temp directory); without --spill all output goes here")
+	rootCmd.Flags().StringP("output-mode", "", infra.DefaultOutputMode, "How stdout and stderr look in the JSON, one of "+strings.Join(infra.OutputModes, ", ")+"; output that isn't UTF-8 is always base64")
+	rootCmd.Flags().StringP("halt", "", "", "Stop early: now or soon, then fail=N, fail=P% or success=N, e.g. soon,fail=3; now kills running jobs, soon lets them finish")
+	rootCmd.Flags().Int64P("seed", "", 0, "Seed for shuffling the order jobs start in, to repeat a run's order (0 = random, the seed used is in the results)")
+	rootCmd.Flags().BoolP("no-shuffle", "", false, "Start jobs in input order instead of shuffling them")
+	rootCmd.Flags().StringP("sort", "", infra.DefaultSort, "Order of the results, one of "+strings.Join(infra.SortKeys, ", "))
+	rootCmd.Flags().BoolP("shell", "", false, "Run commands through --shell-cmd with target values shell-quoted; use {{1|raw}} to skip quoting")
+	rootCmd.Flags().StringP("shell-cmd", "", infra.DefaultShell, "Shell for --shell to run commands with; giving it implies --shell")
+	rootCmd.Flags().StringP("colsep", "", "", "Column separator used to split each target into {{1}} .. {{N}} (default whitespace or comma)")
 	rootCmd.Flags().BoolP("flag-errors", "", false, "Print a message to stderr for all completed jobs with an exit code other than zero")
 	rootCmd.Flags().BoolP("pbar", "p", false, "Display a progress bar which ticks up once per completed job")
 	rootCmd.Flags().StringP("job-timeout", "j", "0", "Per-job timeout in time.Duration format (0 default, must be <= global timeout)")
@@ -0,0 +1,117 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// BatchToken is replaced with every target in a batch when --max-args packs several targets
+// into one command, like xargs -n.
+const BatchToken = "{{@}}"
+
+// Linux won't take a single argument longer than 128KiB (MAX_ARG_STRLEN), which is what a whole
+// command is in --shell mode, and ARG_MAX on macOS is 256KiB for everything.  Stay comfortably
+// under both.
+const maxBatchBytes = 120 * 1024
+
+// buildBatchedCommands packs up to flags.MaxArgs targets into each command, or fewer if adding
+// another would make the command too long to exec.  Targets are quoted so each one is a single
+// word however the command gets run.
+func buildBatchedCommands(command string, targets []target, flags Flags) (CommandList, error) {
+	if flags.TemplateEngine == "go" {
+		return nil, errors.New("--max-args only works with the simple template engine")
+	}
+
+	if !strings.Contains(command, BatchToken) {
+		command = command + " " + BatchToken
+	}
+
+	// per-target placeholders don't mean anything when a command has lots of targets
+	for _, m := range placeholderRE.FindAllStringSubmatch(command, -1) {
+		if m[1] != "" && m[0] != TmpdirToken {
+			return nil, fmt.Errorf("%v can't be used with --max-args, use %v", m[0], BatchToken)
+		}
+	}
+	if flags.Token != "" && flags.Token != DefaultToken && strings.Contains(command, flags.Token) {
+		return nil, fmt.Errorf("--token %v can't be used with --max-args, use %v", flags.Token, BatchToken)
+	}
+
+	renderEnv, err := newEnvRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	renderWorkdir, err := newWorkdirRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	env := environ()
+
+	var ret CommandList
+	var id JobID
+	var batch []string
+	var quoted []string
+	size := len(command) - len(BatchToken)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		d := jobData{Fields: []string{}, ID: id, Seq: int(id) + 1, Env: env}
+		substituted, err := substitutePlaceholders(command, d, false)
+		if err != nil {
+			return err
+		}
+
+		x := Command{}
+		x.Arg = []string{}
+		x.Targets = batch
+		if renderEnv != nil {
+			if x.EnvVars, err = renderEnv(d); err != nil {
+				return err
+			}
+		}
+		if renderWorkdir != nil {
+			if x.Dir, err = renderWorkdir(d); err != nil {
+				return err
+			}
+		}
+		x.Substituted = strings.ReplaceAll(substituted, BatchToken, strings.Join(quoted, " "))
+		x.Status = TBD
+		x.ID = id
+
+		id += 1
+		ret = append(ret, &x)
+
+		batch, quoted = nil, nil
+		size = len(command) - len(BatchToken)
+		return nil
+	}
+
+	for _, t := range targets {
+		q := shellQuote(t.Value)
+
+		if len(batch) > 0 && (len(batch) >= flags.MaxArgs || size+len(q)+1 > maxBatchBytes) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		if size+len(q)+1 > maxBatchBytes {
+			slog.Warn(fmt.Sprintf("target %q is too long to batch, running it on its own", t.Value))
+		}
+
+		batch = append(batch, t.Value)
+		quoted = append(quoted, q)
+		size += len(q) + 1
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
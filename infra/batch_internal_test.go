@@ -0,0 +1,75 @@
+package infra
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_buildBatchedCommands(t *testing.T) {
+
+	t.Parallel()
+
+	targets := targetsFromStrings([]string{"a", "b c", "d", "e", "f"})
+
+	got, err := buildListOfCommands("rm -f {{@}} # {{#}}", targets, Flags{Token: DefaultToken, MaxArgs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+
+	want := CommandList{
+		&Command{ID: 0, Status: TBD, Substituted: "rm -f a 'b c' # 1", Arg: []string{}, Targets: []string{"a", "b c"}},
+		&Command{ID: 1, Status: TBD, Substituted: "rm -f d e # 2", Arg: []string{}, Targets: []string{"d", "e"}},
+		&Command{ID: 2, Status: TBD, Substituted: "rm -f f # 3", Arg: []string{}, Targets: []string{"f"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff\n%s", diff)
+	}
+
+	// no {{@}} means targets go on the end
+	got, err = buildListOfCommands("touch", targets, Flags{Token: DefaultToken, MaxArgs: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("touch a 'b c' d e f", got[0].Substituted); diff != "" {
+		t.Errorf("diff\n%s", diff)
+	}
+
+	// per-target placeholders don't make sense in a batch
+	for _, bad := range []string{"echo {{1}}", "echo {{host}} {{@}}"} {
+		if _, err := buildListOfCommands(bad, targets, Flags{Token: DefaultToken, MaxArgs: 2}); err == nil {
+			t.Errorf("expected an error with %q", bad)
+		}
+	}
+}
+
+func Test_buildBatchedCommands_argMax(t *testing.T) {
+
+	t.Parallel()
+
+	// 100 targets of 10KiB each can't all go in one command
+	var ss []string
+	for i := 0; i < 100; i++ {
+		ss = append(ss, strings.Repeat("x", 10*1024))
+	}
+
+	got, err := buildListOfCommands("echo", targetsFromStrings(ss), Flags{Token: DefaultToken, MaxArgs: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, c := range got {
+		if len(c.Substituted) > maxBatchBytes {
+			t.Errorf("command %v is %v bytes, more than %v", c.ID, len(c.Substituted), maxBatchBytes)
+		}
+		total += len(c.Targets)
+	}
+
+	if len(got) < 2 || total != 100 {
+		t.Errorf("expected 100 targets split over several commands, got %v over %v", total, len(got))
+	}
+}
@@ -0,0 +1,152 @@
+package infra
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// anything in the environment that looks like this is left out of the JSON with --record-env
+var secretEnvRE = regexp.MustCompile(`(?i)(secret|passw|token|key|credential|auth|cookie|session)`)
+
+const redacted = "<redacted>"
+
+// newRunID makes an ID for a run so jobs (and whatever they write) can be tied back to it.
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b) // never returns an error
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// newEnvRenderer renders --env-file and --env, in that order so --env wins, into extra
+// environment variables for each job.  Values are templates like the command is, never shell
+// quoted.  It returns nil if there aren't any.
+func newEnvRenderer(flags Flags) (func(d jobData) (map[string]string, error), error) {
+	specs, err := readEnvFile(flags.EnvFile)
+	if err != nil {
+		return nil, err
+	}
+	specs = append(specs, flags.Env...)
+
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	type envTemplate struct {
+		name   string
+		render renderFunc
+	}
+	var templates []envTemplate
+
+	for _, spec := range specs {
+		name, tmpl, ok := strings.Cut(spec, "=")
+		if !ok || !listNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid env %q, want KEY=value", spec)
+		}
+		render, err := newTextRenderer(tmpl, flags)
+		if err != nil {
+			return nil, fmt.Errorf("env %v: %w", name, err)
+		}
+		templates = append(templates, envTemplate{name, render})
+	}
+
+	return func(d jobData) (map[string]string, error) {
+		env := map[string]string{}
+		for _, t := range templates {
+			v, err := t.render(d)
+			if err != nil {
+				return nil, fmt.Errorf("env %v: %w", t.name, err)
+			}
+			env[t.name] = v
+		}
+		return env, nil
+	}, nil
+}
+
+// readEnvFile reads KEY=value lines.  Blank lines and # comments are skipped, and an export in
+// front is ignored so shell env files work too.
+func readEnvFile(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("env file: %w", err)
+	}
+	defer f.Close()
+
+	var ret []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, strings.TrimPrefix(line, "export "))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("env file: %w", err)
+	}
+
+	return ret, nil
+}
+
+// concurEnv adds the CONCUR_ variables that tell a job where it is in the run.  Anything the user
+// set with --env is left alone.  total is -1 if nobody knows how many jobs there'll be.
+func concurEnv(c *Command, total int, flags Flags) map[string]string {
+	target := c.Target
+	if len(c.Targets) > 0 {
+		target = strings.Join(c.Targets, "\n")
+	}
+
+	env := map[string]string{
+		"CONCUR_TARGET": target,
+		"CONCUR_JOB_ID": strconv.Itoa(int(c.ID)),
+		"CONCUR_SLOT":   strconv.Itoa(c.Slot),
+		"CONCUR_RUN_ID": flags.RunID,
+	}
+	if total >= 0 {
+		env["CONCUR_TOTAL_JOBS"] = strconv.Itoa(total)
+	}
+
+	maps.Copy(env, c.EnvVars)
+	return env
+}
+
+// jobEnviron is the environment a job runs with, nil meaning the same as concur's.  With
+// --record-env it's also saved in the job, minus anything that looks secret.
+func jobEnviron(c *Command, flags Flags) []string {
+	if c.EnvVars == nil && !flags.CleanEnv && !flags.RecordEnv {
+		return nil
+	}
+
+	env := map[string]string{}
+	if !flags.CleanEnv {
+		env = environ()
+	}
+	maps.Copy(env, c.EnvVars)
+
+	if flags.RecordEnv {
+		c.Env = map[string]string{}
+		for k, v := range env {
+			if secretEnvRE.MatchString(k) {
+				v = redacted
+			}
+			c.Env[k] = v
+		}
+	}
+
+	ret := []string{}
+	for k, v := range env {
+		ret = append(ret, k+"="+v)
+	}
+	return ret
+}
@@ -0,0 +1,105 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_newEnvRenderer(t *testing.T) {
+
+	t.Parallel()
+
+	envFile := filepath.Join(t.TempDir(), "job.env")
+	if err := os.WriteFile(envFile, []byte("# comment\n\nexport SITE=lab\nHOST=file-{{1}}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		flags      Flags
+		expected   map[string]string
+		expectPass bool
+	}{
+		{name: "none", flags: Flags{}, expected: nil, expectPass: true},
+		{name: "env", flags: Flags{Env: []string{"HOST={{1}}", "EMPTY="}}, expected: map[string]string{"HOST": "r1", "EMPTY": ""}, expectPass: true},
+		{name: "env wins over file", flags: Flags{EnvFile: envFile, Env: []string{"HOST={{1}}.lab"}}, expected: map[string]string{"SITE": "lab", "HOST": "r1.lab"}, expectPass: true},
+		{name: "not quoted in shell mode", flags: Flags{Shell: DefaultShell, Env: []string{"X={{2}}"}}, expected: map[string]string{"X": "two words"}, expectPass: true},
+		{name: "no equals", flags: Flags{Env: []string{"HOST"}}, expectPass: false},
+		{name: "bad name", flags: Flags{Env: []string{"1HOST=x"}}, expectPass: false},
+		{name: "missing file", flags: Flags{EnvFile: envFile + ".nope"}, expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		render, err := newEnvRenderer(tc.flags)
+
+		if !tc.expectPass {
+			if err == nil {
+				t.Errorf("%v: no error when there should be one", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: error %q when there should be none", tc.name, err)
+			continue
+		}
+
+		var got map[string]string
+		if render != nil {
+			if got, err = render(jobData{Fields: []string{"r1", "two words"}}); err != nil {
+				t.Errorf("%v: error %q when there should be none", tc.name, err)
+			}
+		}
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%v: diff\n%s", tc.name, diff)
+		}
+	}
+}
+
+func Test_jobEnv(t *testing.T) {
+
+	t.Parallel()
+
+	flags := Flags{Token: DefaultToken, GoroutineLimit: 1, JobTimeout: time.Minute, RunID: "run1",
+		CleanEnv: true, RecordEnv: true, Env: []string{"HOST={{1}}", "API_TOKEN=hunter2"}}
+
+	cl, err := buildListOfCommands("env", targetsFromStrings([]string{"r1"}), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got, _, _ := commandLoop(ctx, cancel, cl, flags)
+
+	// CONCUR_TMPDIR is different every time, the workdir tests look at it
+	stdout := slices.DeleteFunc(got[0].Stdout, func(s string) bool { return s == "" || strings.HasPrefix(s, "CONCUR_TMPDIR=") })
+	slices.Sort(stdout)
+	want := []string{"API_TOKEN=hunter2", "CONCUR_JOB_ID=0", "CONCUR_RUN_ID=run1", "CONCUR_SLOT=1", "CONCUR_TARGET=r1", "CONCUR_TOTAL_JOBS=1", "HOST=r1"}
+	if diff := cmp.Diff(want, stdout); diff != "" {
+		t.Errorf("environment diff\n%s", diff)
+	}
+
+	// the job sees the real value, the JSON doesn't
+	if got[0].Env["API_TOKEN"] != redacted {
+		t.Errorf("API_TOKEN should be redacted but is %q", got[0].Env["API_TOKEN"])
+	}
+	if len(got[0].Env) != len(want)+1 {
+		t.Errorf("recorded env should have %v entries: %v", len(want)+1, got[0].Env)
+	}
+
+	// batches get all their targets, one per line
+	c := &Command{Targets: []string{"a", "b"}, Slot: 2}
+	env := concurEnv(c, -1, flags)
+	if env["CONCUR_TARGET"] != "a\nb" {
+		t.Errorf("batch CONCUR_TARGET should be a\\nb but is %q", env["CONCUR_TARGET"])
+	}
+	if _, ok := env["CONCUR_TOTAL_JOBS"]; ok {
+		t.Error("CONCUR_TOTAL_JOBS shouldn't be set when the total isn't known")
+	}
+}
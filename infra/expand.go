@@ -0,0 +1,196 @@
+package infra
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --expand turns one target into many.  It understands
+//
+//	10.1.2.0/28          every address in the block (--cidr-hosts drops network and broadcast)
+//	core-rtr[01-16].dc1  numeric ranges, zero padded to the width of the first number
+//	edge-[1-3,7]         ranges and single numbers mixed together
+//	edge-{a,b,c}         brace alternation
+//
+// and any combination of them, e.g. 10.{1,2}.0.0/30 or pe[1-2]-{re0,re1}.
+
+// {a,b,c} but not {{1}}
+var braceRE = regexp.MustCompile(`\{([^{}]*,[^{}]*)\}`)
+
+// [1-3] or [01-16,20]
+var rangeRE = regexp.MustCompile(`\[([0-9]+(?:-[0-9]+)?(?:,[0-9]+(?:-[0-9]+)?)*)\]`)
+
+// expander expands targets, stopping once it's produced limit of them.  limit 0 means no limit.
+type expander struct {
+	limit     int
+	cidrHosts bool // skip network and broadcast addresses
+	count     int
+	truncated bool
+}
+
+// expandTargets runs every target through the expander.  It also returns the targets which hit
+// the limit; whatever they expanded to up to that point is kept.
+func expandTargets(targets []string, limit int, cidrHosts bool) ([]string, []string, error) {
+	var ret []string
+	var truncated []string
+
+	for _, t := range targets {
+		e := expander{limit: limit, cidrHosts: cidrHosts}
+		expanded, err := e.expand(t)
+		if err != nil {
+			return nil, nil, fmt.Errorf("expanding %q: %w", t, err)
+		}
+		if e.truncated {
+			truncated = append(truncated, t)
+		}
+		ret = append(ret, expanded...)
+	}
+
+	return ret, truncated, nil
+}
+
+func (e *expander) full() bool {
+	if e.limit > 0 && e.count >= e.limit {
+		e.truncated = true
+		return true
+	}
+	return false
+}
+
+// expand does the leftmost brace or range first and recurses on the results, so multiple patterns
+// multiply out.  Whatever's left at the bottom gets a CIDR check.
+func (e *expander) expand(s string) ([]string, error) {
+	braceLoc := braceRE.FindStringSubmatchIndex(s)
+	rangeLoc := rangeRE.FindStringSubmatchIndex(s)
+	if braceLoc != nil && rangeLoc != nil {
+		if braceLoc[0] < rangeLoc[0] {
+			rangeLoc = nil
+		} else {
+			braceLoc = nil
+		}
+	}
+
+	if loc := braceLoc; loc != nil {
+		var ret []string
+		for _, alt := range strings.Split(s[loc[2]:loc[3]], ",") {
+			if e.full() {
+				break
+			}
+			sub, err := e.expand(s[:loc[0]] + alt + s[loc[1]:])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, sub...)
+		}
+		return ret, nil
+	}
+
+	if loc := rangeLoc; loc != nil {
+		max := e.limit
+		if max > 0 {
+			max++ // one past the limit, so we notice we've hit it
+		}
+		items, err := rangeItems(s[loc[2]:loc[3]], max)
+		if err != nil {
+			return nil, err
+		}
+		var ret []string
+		for _, item := range items {
+			if e.full() {
+				break
+			}
+			sub, err := e.expand(s[:loc[0]] + item + s[loc[1]:])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, sub...)
+		}
+		return ret, nil
+	}
+
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return e.expandPrefix(prefix), nil
+	}
+
+	if e.full() {
+		return nil, nil
+	}
+	e.count++
+	return []string{s}, nil
+}
+
+// rangeItems turns "01-03,7" into 01 02 03 7.  A number with a leading zero sets the width
+// everything in its range is padded to.  It stops after max items so [1-100000000] doesn't eat
+// all the memory before the limit kicks in.
+func rangeItems(spec string, max int) ([]string, error) {
+	var ret []string
+
+	for _, part := range strings.Split(spec, ",") {
+		if max > 0 && len(ret) >= max {
+			break
+		}
+
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			ret = append(ret, from)
+			continue
+		}
+
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, err
+		}
+
+		width := 0
+		if len(from) > 1 && from[0] == '0' {
+			width = len(from)
+		}
+
+		step := 1
+		if end < start {
+			step = -1
+		}
+		for i := start; ; i += step {
+			ret = append(ret, fmt.Sprintf("%0*d", width, i))
+			if i == end || (max > 0 && len(ret) >= max) {
+				break
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// expandPrefix lists the addresses in a CIDR block.  With cidrHosts set, IPv4 blocks bigger
+// than a /31 lose their network and broadcast addresses.
+func (e *expander) expandPrefix(p netip.Prefix) []string {
+	var ret []string
+
+	p = p.Masked()
+	skipEnds := e.cidrHosts && p.Addr().Is4() && p.Bits() < 31
+
+	addr := p.Addr()
+	if skipEnds {
+		addr = addr.Next()
+	}
+
+	for ; addr.IsValid() && p.Contains(addr); addr = addr.Next() {
+		if skipEnds && !p.Contains(addr.Next()) {
+			break // broadcast
+		}
+		if e.full() {
+			break
+		}
+		e.count++
+		ret = append(ret, addr.String())
+	}
+
+	return ret
+}
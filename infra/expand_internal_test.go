@@ -0,0 +1,51 @@
+package infra
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_expandTargets(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		targets   []string
+		limit     int
+		cidrHosts bool
+		expected  []string
+		truncated []string
+	}{
+		{targets: []string{"plain", "[::1]"}, expected: []string{"plain", "[::1]"}},
+		{targets: []string{"core-rtr[08-11].dc1"}, expected: []string{"core-rtr08.dc1", "core-rtr09.dc1", "core-rtr10.dc1", "core-rtr11.dc1"}},
+		{targets: []string{"r[1-2,7]"}, expected: []string{"r1", "r2", "r7"}},
+		{targets: []string{"r[3-1]"}, expected: []string{"r3", "r2", "r1"}},
+		{targets: []string{"edge-{a,b,c}"}, expected: []string{"edge-a", "edge-b", "edge-c"}},
+		{targets: []string{"pe[1-2]-{re0,re1}"}, expected: []string{"pe1-re0", "pe1-re1", "pe2-re0", "pe2-re1"}},
+		{targets: []string{"10.1.2.0/30"}, expected: []string{"10.1.2.0", "10.1.2.1", "10.1.2.2", "10.1.2.3"}},
+		{targets: []string{"10.1.2.0/30"}, cidrHosts: true, expected: []string{"10.1.2.1", "10.1.2.2"}},
+		{targets: []string{"10.1.2.5/31"}, cidrHosts: true, expected: []string{"10.1.2.4", "10.1.2.5"}},
+		{targets: []string{"10.{1,2}.0.0/31"}, expected: []string{"10.1.0.0", "10.1.0.1", "10.2.0.0", "10.2.0.1"}},
+		{targets: []string{"2001:db8::/127"}, expected: []string{"2001:db8::", "2001:db8::1"}},
+		{targets: []string{"10.0.0.0/8", "r[1-2]"}, limit: 3, expected: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "r1", "r2"}, truncated: []string{"10.0.0.0/8"}},
+		{targets: []string{"r[1-100000000]"}, limit: 2, expected: []string{"r1", "r2"}, truncated: []string{"r[1-100000000]"}},
+		{targets: []string{"{a,b}{c,d}"}, limit: 4, expected: []string{"ac", "ad", "bc", "bd"}}, // exactly at the limit isn't truncated
+	}
+
+	for _, tc := range testCases {
+		got, truncated, err := expandTargets(tc.targets, tc.limit, tc.cidrHosts)
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.targets)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%q diff\n%s", tc.targets, diff)
+		}
+
+		if diff := cmp.Diff(tc.truncated, truncated); diff != "" {
+			t.Errorf("%q truncated diff\n%s", tc.targets, diff)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilteredTarget is a target that --unique, --include-regex or --exclude dropped, and why.
+type FilteredTarget struct {
+	Target string `json:"target"`
+	Reason string `json:"reason"`
+}
+
+// targetPattern is one --exclude.  re: in front makes it a regex, glob characters make it a glob,
+// and anything else has to match the whole target exactly.
+type targetPattern struct {
+	spec  string
+	re    *regexp.Regexp
+	glob  bool
+	exact string
+}
+
+func parseTargetPattern(spec string) (targetPattern, error) {
+	p := targetPattern{spec: spec}
+
+	switch {
+	case strings.HasPrefix(spec, "re:"):
+		re, err := regexp.Compile(strings.TrimPrefix(spec, "re:"))
+		if err != nil {
+			return p, fmt.Errorf("exclude %q: %w", spec, err)
+		}
+		p.re = re
+	case strings.ContainsAny(spec, "*?["):
+		if _, err := path.Match(spec, ""); err != nil {
+			return p, fmt.Errorf("exclude %q: %w", spec, err)
+		}
+		p.glob = true
+	default:
+		p.exact = spec
+	}
+
+	return p, nil
+}
+
+func (p targetPattern) match(s string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(s)
+	case p.glob:
+		ok, _ := path.Match(p.spec, s)
+		return ok
+	default:
+		return s == p.exact
+	}
+}
+
+// filterTargets drops duplicate targets with --unique, then anything --include-regex doesn't
+// match, then anything an --exclude or --exclude-file pattern does.
+func filterTargets(targets []target, flags Flags) ([]target, []FilteredTarget, error) {
+	if !flags.Unique && flags.IncludeRegex == "" && len(flags.Exclude) == 0 && flags.ExcludeFile == "" {
+		return targets, nil, nil
+	}
+
+	var include *regexp.Regexp
+	if flags.IncludeRegex != "" {
+		var err error
+		if include, err = regexp.Compile(flags.IncludeRegex); err != nil {
+			return nil, nil, fmt.Errorf("include regex: %w", err)
+		}
+	}
+
+	specs := flags.Exclude
+	if flags.ExcludeFile != "" {
+		f, err := os.Open(flags.ExcludeFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exclude file: %w", err)
+		}
+		defer f.Close()
+
+		// same rules as --lines, so blank lines and # comments are skipped
+		fromFile, err := ReadTargets(f, Flags{Lines: true})
+		if err != nil {
+			return nil, nil, fmt.Errorf("exclude file: %w", err)
+		}
+		specs = append(append([]string{}, specs...), fromFile...)
+	}
+
+	var excludes []targetPattern
+	for _, spec := range specs {
+		p, err := parseTargetPattern(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		excludes = append(excludes, p)
+	}
+
+	var kept []target
+	var dropped []FilteredTarget
+	seen := map[string]bool{}
+
+Targets:
+	for _, t := range targets {
+		if flags.Unique {
+			if seen[t.Value] {
+				dropped = append(dropped, FilteredTarget{t.Value, "duplicate"})
+				continue
+			}
+			seen[t.Value] = true
+		}
+
+		if include != nil && !include.MatchString(t.Value) {
+			dropped = append(dropped, FilteredTarget{t.Value, "doesn't match --include-regex " + flags.IncludeRegex})
+			continue
+		}
+
+		for _, p := range excludes {
+			if p.match(t.Value) {
+				dropped = append(dropped, FilteredTarget{t.Value, "excluded by " + p.spec})
+				continue Targets
+			}
+		}
+
+		kept = append(kept, t)
+	}
+
+	return kept, dropped, nil
+}
@@ -0,0 +1,77 @@
+package infra
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_filterTargets(t *testing.T) {
+
+	t.Parallel()
+
+	excludeFile := filepath.Join(t.TempDir(), "maintenance.txt")
+	if err := os.WriteFile(excludeFile, []byte("# down for patching\nr2\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{"r1", "r2", "r1", "db1", "db2", "sw1"}
+
+	testCases := []struct {
+		name       string
+		flags      Flags
+		expected   []string
+		dropped    []FilteredTarget
+		expectPass bool
+	}{
+		{name: "nothing", flags: Flags{}, expected: targets, expectPass: true},
+		{name: "unique", flags: Flags{Unique: true}, expected: []string{"r1", "r2", "db1", "db2", "sw1"},
+			dropped: []FilteredTarget{{"r1", "duplicate"}}, expectPass: true},
+		{name: "literal", flags: Flags{Exclude: []string{"r1", "db"}}, expected: []string{"r2", "db1", "db2", "sw1"},
+			dropped: []FilteredTarget{{"r1", "excluded by r1"}, {"r1", "excluded by r1"}}, expectPass: true},
+		{name: "glob", flags: Flags{Exclude: []string{"db*"}}, expected: []string{"r1", "r2", "r1", "sw1"},
+			dropped: []FilteredTarget{{"db1", "excluded by db*"}, {"db2", "excluded by db*"}}, expectPass: true},
+		{name: "regex", flags: Flags{Exclude: []string{"re:^(sw|db)1$"}}, expected: []string{"r1", "r2", "r1", "db2"},
+			dropped: []FilteredTarget{{"db1", "excluded by re:^(sw|db)1$"}, {"sw1", "excluded by re:^(sw|db)1$"}}, expectPass: true},
+		{name: "include", flags: Flags{IncludeRegex: "^r", Unique: true, ExcludeFile: excludeFile}, expected: []string{"r1"},
+			dropped: []FilteredTarget{
+				{"r2", "excluded by r2"},
+				{"r1", "duplicate"},
+				{"db1", "doesn't match --include-regex ^r"},
+				{"db2", "doesn't match --include-regex ^r"},
+				{"sw1", "doesn't match --include-regex ^r"},
+			}, expectPass: true},
+		{name: "bad regex", flags: Flags{Exclude: []string{"re:("}}, expectPass: false},
+		{name: "bad glob", flags: Flags{Exclude: []string{"db["}}, expectPass: false},
+		{name: "bad include", flags: Flags{IncludeRegex: "("}, expectPass: false},
+		{name: "missing file", flags: Flags{ExcludeFile: excludeFile + ".nope"}, expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, dropped, err := filterTargets(targetsFromStrings(targets), tc.flags)
+
+		if !tc.expectPass {
+			if err == nil {
+				t.Errorf("%v: no error when there should be one", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: error %q when there should be none", tc.name, err)
+			continue
+		}
+
+		var values []string
+		for _, t := range got {
+			values = append(values, t.Value)
+		}
+		if diff := cmp.Diff(tc.expected, values); diff != "" {
+			t.Errorf("%v: kept diff\n%s", tc.name, diff)
+		}
+		if diff := cmp.Diff(tc.dropped, dropped); diff != "" {
+			t.Errorf("%v: dropped diff\n%s", tc.name, diff)
+		}
+	}
+}
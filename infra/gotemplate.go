@@ -0,0 +1,105 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// helpers available to --template-engine go.  Argument order follows sprig so the
+// value being worked on comes last and things pipe nicely: {{ .Target | trimSuffix ".bin" | upper }}
+var templateFuncs = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"base":       filepath.Base,
+	"dir":        filepath.Dir,
+	"env":        os.Getenv,
+	"shquote":    shellQuote,
+	"raw":        func(v any) string { return fmt.Sprint(v) },
+	"autoquote":  func(v any) string { return shellQuote(fmt.Sprint(v)) },
+	"tmpdir":     func() string { return TmpdirToken },
+	"default": func(def, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	},
+}
+
+// newGoRenderer parses command as a text/template once, up front, so syntax errors show up before anything runs.
+// With quote set everything the template prints is shell quoted, the same as {{1}} is.
+func newGoRenderer(command string, quote bool) (renderFunc, error) {
+	tmpl, err := template.New("command").Funcs(templateFuncs).Option("missingkey=error").Parse(command)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+	if quote {
+		for _, t := range tmpl.Templates() {
+			quoteActions(t.Tree.Root)
+		}
+	}
+
+	return func(d jobData) (string, error) {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, d); err != nil {
+			return "", err
+		}
+		return sb.String(), nil
+	}, nil
+}
+
+// quoteActions tacks autoquote onto the end of every {{ }} that prints something, so it's quoted
+// after all the helpers have had their go at it, like html/template does with its escaping.  A
+// pipeline ending in raw opts out, and one ending in shquote or tmpdir is quoted already or will be.
+func quoteActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			quoteActions(c)
+		}
+	case *parse.IfNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.WithNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return // {{ $x := ... }} doesn't print anything
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if id, ok := last.Args[0].(*parse.IdentifierNode); ok {
+			switch id.Ident {
+			case "raw", "shquote", "tmpdir":
+				return
+			}
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("autoquote").SetTree(nil).SetPos(n.Pos)},
+		})
+	}
+}
+
+// environ returns the environment as a map for templates to look things up in.
+func environ() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
@@ -0,0 +1,106 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a fail=P% halt doesn't judge until at least this many jobs are done, or they all are
+const haltMinJobs = 3
+
+// why runLoop stopped starting jobs, so it can tell Skipped from NotStarted
+var errHalted = errors.New("halted")
+
+// haltPolicy is --halt when,condition.  now kills running jobs when the condition's met, soon
+// lets them finish but doesn't start any more.  The condition is fail=N, fail=P% or success=N.
+type haltPolicy struct {
+	spec    string
+	now     bool
+	fail    int // halt after this many failed jobs
+	failPct int // or this percentage of the jobs done so far
+	success int // halt after this many jobs worked
+
+	done, failed, succeeded int
+}
+
+func parseHalt(spec string) (haltPolicy, error) {
+	h := haltPolicy{spec: spec}
+	if spec == "" {
+		return h, nil
+	}
+
+	when, cond, ok := strings.Cut(spec, ",")
+	if !ok {
+		return h, fmt.Errorf("invalid halt %q, want now or soon then a condition, e.g. soon,fail=1", spec)
+	}
+
+	switch when {
+	case "now":
+		h.now = true
+	case "soon":
+	default:
+		return h, fmt.Errorf("invalid halt %q, want now or soon, not %q", spec, when)
+	}
+
+	key, value, _ := strings.Cut(cond, "=")
+	pct := key == "fail" && strings.HasSuffix(value, "%")
+	if pct {
+		value = strings.TrimSuffix(value, "%")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || (pct && n > 100) {
+		return h, fmt.Errorf("invalid halt %q, want fail=N, fail=P%% or success=N", spec)
+	}
+
+	switch {
+	case key == "fail" && pct:
+		h.failPct = n
+	case key == "fail":
+		h.fail = n
+	case key == "success":
+		h.success = n
+	default:
+		return h, fmt.Errorf("invalid halt %q, want fail=N, fail=P%% or success=N", spec)
+	}
+
+	return h, nil
+}
+
+// record counts a finished job and says whether the run should halt because of it.  total is how
+// many jobs there are, -1 if nobody knows.
+func (h *haltPolicy) record(c *Command, total int) bool {
+	if h.spec == "" || c.Status == NotStarted || c.Status == Skipped {
+		return false
+	}
+
+	h.done++
+	if c.Status == Finished && c.ReturnCode == 0 {
+		h.succeeded++
+	} else {
+		h.failed++
+	}
+
+	switch {
+	case h.fail > 0:
+		return h.failed >= h.fail
+	case h.success > 0:
+		return h.succeeded >= h.success
+	case h.failPct > 0:
+		if h.done < haltMinJobs && h.done != total {
+			return false
+		}
+		return h.failed*100 >= h.failPct*h.done
+	}
+
+	return false
+}
+
+// reason is what to tell the user when the halt fires.
+func (h *haltPolicy) reason() string {
+	if h.success > 0 {
+		return fmt.Sprintf("%v jobs worked", h.succeeded)
+	}
+	return fmt.Sprintf("%v of %v jobs failed", h.failed, h.done)
+}
@@ -0,0 +1,113 @@
+package infra
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_parseHalt(t *testing.T) {
+
+	t.Parallel()
+
+	failed := &Command{Status: Errored, ReturnCode: 1}
+	worked := &Command{Status: Finished, ReturnCode: 0}
+
+	testCases := []struct {
+		spec       string
+		jobs       []*Command
+		total      int
+		expected   int // how many jobs it takes to halt, 0 for never
+		expectPass bool
+	}{
+		{spec: "", jobs: []*Command{failed, failed}, total: 2, expected: 0, expectPass: true},
+		{spec: "now,fail=1", jobs: []*Command{worked, failed}, total: 2, expected: 2, expectPass: true},
+		{spec: "soon,fail=2", jobs: []*Command{failed, worked, failed}, total: 3, expected: 3, expectPass: true},
+		{spec: "soon,success=2", jobs: []*Command{worked, failed, worked}, total: 3, expected: 3, expectPass: true},
+		{spec: "now,fail=50%", jobs: []*Command{failed, worked, worked, failed}, total: 10, expected: 4, expectPass: true},
+		{spec: "now,fail=50%", jobs: []*Command{failed, failed}, total: 2, expected: 2, expectPass: true},
+		{spec: "now,fail=50%", jobs: []*Command{failed, failed}, total: -1, expected: 0, expectPass: true},
+		{spec: "soon,fail=1", jobs: []*Command{{Status: Skipped, ReturnCode: -1}}, total: 2, expected: 0, expectPass: true},
+		{spec: "now", expectPass: false},
+		{spec: "later,fail=1", expectPass: false},
+		{spec: "soon,fail=0", expectPass: false},
+		{spec: "soon,fail=101%", expectPass: false},
+		{spec: "soon,success=10%", expectPass: false},
+		{spec: "soon,wobble=1", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		h, err := parseHalt(tc.spec)
+
+		if !tc.expectPass {
+			if err == nil {
+				t.Errorf("no error when there should be one with %q", tc.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.spec)
+			continue
+		}
+
+		got := 0
+		for i, c := range tc.jobs {
+			if h.record(c, tc.total) {
+				got = i + 1
+				break
+			}
+		}
+		if got != tc.expected {
+			t.Errorf("%q: expected to halt after %v jobs, got %v", tc.spec, tc.expected, got)
+		}
+	}
+}
+
+func Test_commandLoop_halt(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		flags    Flags
+		expected map[string]JobStatus // by target
+	}{
+		{
+			name:     "soon lets running jobs finish",
+			flags:    Flags{Halt: "soon,fail=1", GoroutineLimit: 2},
+			expected: map[string]JobStatus{"0.5": Finished, "x": Errored, "0": Skipped, "0.1": Skipped},
+		},
+		{
+			name:     "now kills them",
+			flags:    Flags{Halt: "now,fail=1", GoroutineLimit: 2},
+			expected: map[string]JobStatus{"0.5": Cancelled, "x": Errored, "0": Skipped, "0.1": Skipped},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc.flags.Token = DefaultToken
+		tc.flags.JobTimeout = time.Minute
+		tc.flags.NoShuffle = true
+		tc.flags.LogLevel = "q"
+		cmdList, err := buildListOfCommands("sleep {{1}}", targetsFromStrings([]string{"0.5", "x", "0", "0.1"}), tc.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		resList, _, halted := commandLoop(ctx, ctxCancel, cmdList, tc.flags)
+
+		got := map[string]JobStatus{}
+		for _, c := range resList {
+			got[c.Target] = c.Status
+		}
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%v: status diff\n%s", tc.name, diff)
+		}
+		if halted != tc.flags.Halt {
+			t.Errorf("%v: expected halted %q, got %q", tc.name, tc.flags.Halt, halted)
+		}
+	}
+}
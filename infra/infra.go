@@ -4,17 +4,19 @@ package infra
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	_ "log" // magic to make slog look like log
 	"log/slog"
 	"math"
-	"math/rand"
 	"os"
 	"os/exec"
 	"runtime"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
@@ -28,6 +30,9 @@ const (
 	Finished
 	Errored
 	TimedOut
+	Cancelled  // killed because the run was over, e.g. --any had its answer
+	NotStarted // the run was over before it got a slot
+	Skipped    // --halt stopped it starting
 )
 
 var flagErrors bool
@@ -53,6 +58,12 @@ func (j JobStatus) String() string {
 		return "Errored"
 	case TimedOut:
 		return "TimedOut"
+	case Cancelled:
+		return "Cancelled"
+	case NotStarted:
+		return "NotStarted"
+	case Skipped:
+		return "Skipped"
 	default:
 		return "Unknown"
 	}
@@ -64,27 +75,56 @@ type Results struct {
 }
 
 type ResultsInfo struct {
-	CoroutineLimit        int           `json:"coroutineLimit"`
-	InternalSystemRunTime time.Duration `json:"-"`
-	SystemRuntimeString   string        `json:"systemRuntime"`
-	OriginalCommand       string        `json:"originalCommand"`
-	Timeout               time.Duration `json:"timeout"` // rename this?
+	CoroutineLimit        int              `json:"coroutineLimit"`
+	TotalJobs             int              `json:"totalJobs"`
+	InternalSystemRunTime time.Duration    `json:"-"`
+	SystemRuntimeString   string           `json:"systemRuntime"`
+	OriginalCommand       string           `json:"originalCommand"`
+	RunID                 string           `json:"runId"`
+	Seed                  int64            `json:"seed,omitempty"` // --seed that gets the same job order again
+	Filtered              []FilteredTarget `json:"filtered,omitempty"`
+	Halted                string           `json:"halted,omitempty"`
+	Interrupted           bool             `json:"interrupted"`
+	ResultsDir            string           `json:"resultsDir,omitempty"`
+	Timeout               time.Duration    `json:"timeout"` // rename this?
 }
 
 type Command struct {
-	ID          JobID     `json:"id"`
-	Status      JobStatus `json:"jobstatus"`
-	Substituted string    `json:"substituted"`
-	Arg         string    `json:"arg"`
-	Stdout      []string  `json:"stdout"`
-	//Stdin       string    `json:"stdin"`
-	Stderr           []string      `json:"stderr"`
-	StartTime        time.Time     `json:"starttime"`
-	EndTime          time.Time     `json:"endtime"`
-	RunTimePrintable string        `json:"runtime"`
-	RunTime          time.Duration `json:"-"` // msec runtime for sorting
-	ReturnCode       int           `json:"returncode"`
-	JobTimeout       time.Duration `json:"jobtimeout"` // TODO these print as ints, would be nice to print as string.
+	ID               JobID             `json:"id"`
+	Status           JobStatus         `json:"jobstatus"`
+	Winner           bool              `json:"winner,omitempty"` // the job --any or --first was waiting for
+	Substituted      string            `json:"substituted"`
+	Target           string            `json:"target,omitempty"`
+	Arg              []string          `json:"arg"`
+	Vars             map[string]string `json:"vars,omitempty"`
+	Targets          []string          `json:"targets,omitempty"` // everything a --max-args batch covered
+	Slot             int               `json:"slot"`
+	Stdout           []string          `json:"stdout"`
+	Stdin            string            `json:"stdin,omitempty"`     // inline stdin from --stdin-template
+	StdinFile        string            `json:"stdinFile,omitempty"` // file stdin is read from
+	StdinData        []byte            `json:"-"`                   // a --pipe chunk, dropped once the job's done with it
+	Chunk            *ChunkInfo        `json:"chunk,omitempty"`     // which bit of the --pipe input this job got
+	EnvVars          map[string]string `json:"-"`                   // set on top of the environment for this job
+	Env              map[string]string `json:"env,omitempty"`       // the whole environment, with --record-env
+	Dir              string            `json:"dir,omitempty"`       // working directory from --workdir
+	Attempts         []Attempt         `json:"attempts,omitempty"`  // every try with --retries
+	Verdict          string            `json:"verdict,omitempty"`   // how the tries went overall
+	TmpDir           string            `json:"tmpdir,omitempty"`    // scratch directory, if it was kept
+	Stderr           []string          `json:"stderr"`
+	Encoding         string            `json:"encoding,omitempty"`        // base64 if stdout and stderr are
+	StdoutTruncated  bool              `json:"stdoutTruncated,omitempty"` // --max-output dropped the middle
+	StderrTruncated  bool              `json:"stderrTruncated,omitempty"`
+	BytesDropped     int64             `json:"bytesDropped,omitempty"` // from both streams
+	StdoutFile       string            `json:"stdoutFile,omitempty"`   // where stdout went instead, with --spill
+	StderrFile       string            `json:"stderrFile,omitempty"`
+	StartTime        time.Time         `json:"starttime"`
+	EndTime          time.Time         `json:"endtime"`
+	RunTimePrintable string            `json:"runtime"`
+	RunTime          time.Duration     `json:"-"` // msec runtime for sorting
+	ReturnCode       int               `json:"returncode"`
+	Signal           string            `json:"signal,omitempty"` // what killed the job, if anything did
+	Error            string            `json:"error,omitempty"`  // why a job couldn't run at all
+	JobTimeout       time.Duration     `json:"jobtimeout"`       // TODO these print as ints, would be nice to print as string.
 }
 
 func (c Command) String() string {
@@ -98,13 +138,63 @@ type CommandList []*Command
 // type CommandMap map[JobID]*Command
 type CommandMap map[int]*Command
 
+// DefaultKillGrace is how long a job gets to clean up after --kill-signal before it's SIGKILLed.
+const DefaultKillGrace = 5 * time.Second
+
 // TODO I think most of my testing is around varying these flags.
 type Flags struct {
 	Any                bool
+	KeepRunning        bool // let everything else finish once --any or --first has a winner
 	ConcurrentJobLimit string
 	GoroutineLimit     int // derived from ConcurrentJobLimit
 	Timeout            time.Duration
 	Token              string
+	ColumnDelimiter    string
+	TemplateEngine     string
+	Shell              string        // run commands with this, e.g. "/bin/sh -c".  Empty means exec directly.
+	StdinFile          string        // every job reads this file on stdin
+	StdinTemplate      string        // per-target stdin, inline or @file
+	Pipe               bool          // split stdin into chunks and feed one to each job
+	BlockSize          int           // how big --pipe chunks are
+	RecordEnd          string        // --pipe chunks end with this
+	Reassemble         string        // write --pipe output here in chunk order
+	Env                []string      // KEY=template, one per --env
+	EnvFile            string        // more KEY=template, one per line
+	CleanEnv           bool          // jobs start with an empty environment
+	RecordEnv          bool          // save each job's environment in the JSON
+	RunID              string        // CONCUR_RUN_ID, made up by Do if it's empty
+	Unique             bool          // drop duplicate targets
+	Exclude            []string      // drop targets matching these, one per --exclude
+	ExcludeFile        string        // more --exclude patterns, one per line
+	IncludeRegex       string        // drop targets that don't match this
+	KillSignal         string        // sent to a job's process group when it's out of time
+	KillGrace          time.Duration // how long after KillSignal before SIGKILL
+	Retries            int           // run failed jobs up to this many more times
+	RetryDelay         time.Duration // wait this long before the first retry, doubling after that
+	RetryOn            []string      // which failures are worth retrying, all of them if empty
+	Halt               string        // when,condition to stop the run early, e.g. soon,fail=3
+	MaxOutput          int           // keep at most this much of each stream of each job, 0 for all of it
+	MaxOutputTotal     int           // how much output all the jobs can hold between them, 0 for no limit
+	Spill              int           // write a job's stream to a file once it's bigger than this
+	ResultsDir         string        // where spilled output goes, a temp directory if empty
+	OutputMode         string        // how stdout and stderr look in the JSON, lines if empty
+	Seed               int64         // for the shuffle, made up by Do if it's zero
+	NoShuffle          bool          // start jobs in input order
+	Sort               string        // how Commands are ordered at the end
+	Workdir            string        // template for where each job runs
+	KeepTmp            bool          // don't remove jobs' scratch directories
+	MaxArgs            int           // pack up to this many targets into each command
+	Lines              bool          // stdin has one target per line
+	Null               bool          // stdin targets are NUL separated
+	InputDelimiter     string        // stdin targets are separated by this
+	NoSkip             bool          // keep blank and # entries from stdin
+	Expand             bool          // expand CIDRs, [1-3] and {a,b} in targets
+	ExpandLimit        int           // most targets one target can expand into, 0 for no limit
+	CIDRHosts          bool          // skip network and broadcast when expanding CIDRs
+	TargetsFile        string        // CSV/TSV with a header row
+	Lists              []string      // name=a,b,c or name=@file, one per --list
+	Zip                bool          // pair lists up instead of taking the cross product
+	ZipShortest        bool          // zip, and stop at the end of the shortest list
 	FlagErrors         bool
 	FirstZero          bool
 	Pbar               bool
@@ -112,10 +202,8 @@ type Flags struct {
 	LogLevel           string
 }
 
-func Do(template string, targets []string, flags Flags) Results {
+func Do(template string, targets []string, flags Flags) (Results, error) {
 	// do all the heavy lifting here
-	var ctx context.Context
-	var cancelCtx context.CancelFunc
 	var res = Results{}
 
 	slog.Debug(fmt.Sprintf("calling Do with %v %v %v", template, targets, flags))
@@ -123,22 +211,46 @@ func Do(template string, targets []string, flags Flags) Results {
 	flagErrors = flags.FlagErrors
 	systemStartTime := time.Now()
 
-	switch flags.Timeout {
-	case 0:
-		ctx, cancelCtx = context.WithCancel(context.Background())
-
-	default:
-		ctx, cancelCtx = context.WithTimeout(context.Background(), flags.Timeout)
+	if flags.RunID == "" {
+		flags.RunID = newRunID()
+	}
+	if flags.Seed == 0 && !flags.NoShuffle {
+		flags.Seed = newSeed()
 	}
 
+	ctx, cancelCtx := newLoopContext(flags)
+
 	//ctx = loginfra.WithLogger(ctx, Logger)
 	defer cancelCtx()
 
+	interrupted, stopCatching := catchInterrupts(cancelCtx, flags)
+	defer stopCatching()
+
+	if err := checkTemplateNotTarget(template, targets, flags); err != nil {
+		return res, err
+	}
+
 	// build a list of commandsToRun
-	commandsToRun, err := buildListOfCommands(template, targets, flags.Token)
+	allTargets, filtered, err := buildTargets(targets, flags)
 	if err != nil {
-		//fmt.Fprint(os.Stderr, err)
-		slog.Error(fmt.Sprintf("error building list of commands: %v", err))
+		return res, fmt.Errorf("error building list of targets: %w", err)
+	}
+
+	if _, err := parseRetryOn(flags.RetryOn); err != nil {
+		return res, err
+	}
+	if _, err := parseHalt(flags.Halt); err != nil {
+		return res, err
+	}
+
+	commandsToRun, err := buildListOfCommands(template, allTargets, flags)
+	if err != nil {
+		return res, fmt.Errorf("error building list of commands: %w", err)
+	}
+
+	// lists multiply, make sure nobody's surprised by how many jobs that turned into
+	if len(flags.Lists) > 0 {
+		notice(flags, "running %v jobs", len(commandsToRun))
 	}
 
 	// flag fixup.
@@ -148,7 +260,36 @@ func Do(template string, targets []string, flags Flags) Results {
 		flags.GoroutineLimit = len(commandsToRun)
 	}
 	// go run the things
-	completedCommands, pbarOffset := commandLoop(ctx, cancelCtx, commandsToRun, flags)
+	completedCommands, pbarOffset, halted := commandLoop(ctx, cancelCtx, commandsToRun, flags)
+
+	res = makeResults(template, completedCommands, systemStartTime, pbarOffset, flags)
+	res.Info.TotalJobs = len(commandsToRun)
+	res.Info.Filtered = filtered
+	res.Info.Halted = halted
+	res.Info.Interrupted = interrupted()
+	res.Info.ResultsDir = spillDirFrom(ctx).where()
+
+	return res, nil
+}
+
+// newLoopContext makes the context all jobs run under, which is where the global timeout, the
+// --max-output-total budget and the --spill directory live.
+func newLoopContext(flags Flags) (context.Context, context.CancelFunc) {
+	ctx := withOutputBudget(context.Background(), flags)
+	ctx = withSpillDir(ctx, flags)
+
+	switch flags.Timeout {
+	case 0:
+		return context.WithCancel(ctx)
+
+	default:
+		return context.WithTimeout(ctx, flags.Timeout)
+	}
+}
+
+// makeResults wraps up a run.
+func makeResults(template string, completedCommands CommandList, systemStartTime time.Time, pbarOffset time.Duration, flags Flags) Results {
+	var res = Results{}
 
 	// finalizing
 	systemEndTime := time.Now()
@@ -161,10 +302,21 @@ func Do(template string, targets []string, flags Flags) Results {
 	res.Info.CoroutineLimit = flags.GoroutineLimit
 	res.Info.OriginalCommand = template
 	res.Info.Timeout = flags.Timeout
+	res.Info.RunID = flags.RunID
+	res.Info.Seed = flags.Seed
 
 	return res
 }
 
+// notice tells the user something they really ought to see whatever the log level is, unless
+// they've asked for quiet.
+func notice(flags Flags, format string, a ...any) {
+	if flags.LogLevel == "q" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "concur: "+format+"\n", a...)
+}
+
 func GetJSONReport(res Results) (string, error) {
 	res.Info.SystemRuntimeString = res.Info.InternalSystemRunTime.Round(time.Millisecond).String()
 	jsonResults, err := json.MarshalIndent(res, "", " ")
@@ -198,27 +350,115 @@ func ReportDone(res Results, flags Flags) {
 }
 
 // TODO return an error here?  who'd receive it?
-func executeSingleCommand(jobCtx context.Context, jobCancel context.CancelFunc, c *Command) {
-
-	var outb, errb strings.Builder
+// What it does return is the job's stderr as it came out, for --retry-on to look at, and a
+// function that hands what its output took from --max-output-total back for when the output's
+// going to be thrown away, as it is when the job's retried.
+func executeSingleCommand(jobCtx context.Context, jobCancel context.CancelFunc, c *Command, flags Flags) (stderr []byte, release func()) {
+
+	outb := newCapture(flags.MaxOutput, budgetFrom(jobCtx))
+	errb := newCapture(flags.MaxOutput, budgetFrom(jobCtx))
+	release = func() {
+		outb.release()
+		errb.release()
+	}
+	spill := spillDirFrom(jobCtx)
+	if spill != nil {
+		outb.spillTo(flags.Spill, func() (*os.File, error) { return spill.create(c, "stdout", flags) })
+		errb.spillTo(flags.Spill, func() (*os.File, error) { return spill.create(c, "stderr", flags) })
+	}
 
 	//l := loginfra.GetLogger(jobCtx)
 	//l.Warning("esc warn")
 
 	defer jobCancel() // I assume I need this - ??
 
+	c.StartTime = time.Now()
+
+	cleanup, err := jobDirs(c, flags)
+	if err != nil {
+		failedToStart(c, err)
+		return nil, release
+	}
+	defer cleanup()
+
 	// name is command name, args is slice of arguments to that command
-	f := strings.Fields(c.Substituted)
+	f, err := commandLine(c.Substituted, flags.Shell)
+	if err != nil {
+		failedToStart(c, err)
+		return nil, release
+	}
 	name, args := f[0], f[1:]
 
-	c.StartTime = time.Now()
 	cmd := exec.CommandContext(jobCtx, name, args...)
+	cmd.Env = jobEnviron(c, flags)
+	cmd.Dir = c.Dir
+	waitGroup := setupKill(cmd, flags)
+
+	stdin, err := jobStdin(c, flags)
+	if err != nil {
+		failedToStart(c, err)
+		return nil, release
+	}
+	if closer, ok := stdin.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
 
-	cmd.Stdout = &outb
-	cmd.Stderr = &errb
+	wantOut, wantErr := true, true
+	if flags.OutputMode == OutputNone && spill == nil {
+		// nobody's ever going to see it, except maybe --retry-on
+		wantOut, wantErr = false, watchesStderr(flags)
+	}
+	var pipes []*jobPipe
+	finishPipes := func() {
+		for _, p := range pipes {
+			p.finish(pipeDrainDelay)
+		}
+	}
+	for _, s := range []struct {
+		want bool
+		dst  *capture
+		fd   *io.Writer
+	}{{wantOut, outb, &cmd.Stdout}, {wantErr, errb, &cmd.Stderr}} {
+		if !s.want {
+			continue
+		}
+		p, err := newJobPipe(s.dst)
+		if err != nil {
+			finishPipes()
+			failedToStart(c, err)
+			return nil, release
+		}
+		pipes = append(pipes, p)
+		*s.fd = p.w
+	}
 
 	c.Status = Running
-	err := cmd.Run()
+	err = cmd.Start()
+	for _, p := range pipes {
+		p.started()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	waitGroup()
+	finishPipes()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// the job exited fine, it's only its stdin that something else was still sitting on
+		err = nil
+	}
+
+	var spillErr error
+	c.StdoutFile, spillErr = outb.close()
+	if spillErr != nil {
+		slog.Error(fmt.Sprintf("spilling stdout: %v", spillErr))
+	}
+	c.StderrFile, spillErr = errb.close()
+	if spillErr != nil {
+		slog.Error(fmt.Sprintf("spilling stderr: %v", spillErr))
+	}
 
 	c.EndTime = time.Now()
 	c.RunTime = c.EndTime.Sub(c.StartTime)
@@ -230,18 +470,73 @@ func executeSingleCommand(jobCtx context.Context, jobCancel context.CancelFunc,
 			// return fmt.Errorf("command timed out: %w", err)
 			c.Status = TimedOut
 			slog.Info(fmt.Sprintf("command timed out: %v\n", err))
+		} else if jobCtx.Err() == context.Canceled {
+			c.Status = Cancelled
 		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			c.ReturnCode = exitError.ExitCode()
+		} else {
+			// never got as far as running, e.g. command not found
+			c.ReturnCode = -1
+			c.Error = err.Error()
 		}
 	} else {
 		c.Status = Finished
 		c.ReturnCode = 0
 	}
 
-	c.Stdout = strings.Split(outb.String(), "\n")
-	c.Stderr = strings.Split(errb.String(), "\n")
+	c.Signal = exitSignal(cmd.ProcessState)
+
+	// JSON can't hold anything that isn't UTF-8, so binary output gets base64ed whatever the mode
+	mode := flags.OutputMode
+	if (mode == "" || mode == OutputLines || mode == OutputRaw) && !(outb.text() && errb.text()) {
+		mode = OutputBase64
+	}
+	c.Encoding = ""
+	if mode == OutputBase64 {
+		c.Encoding = "base64"
+	}
+
+	c.Stdout = outb.render(mode)
+	c.Stderr = errb.render(mode)
+	c.StdoutTruncated = outb.dropped() > 0
+	c.StderrTruncated = errb.dropped() > 0
+	c.BytesDropped = outb.dropped() + errb.dropped()
 
+	if !watchesStderr(flags) {
+		return nil, release
+	}
+	return errb.raw(), release
+}
+
+// failedToStart fills in c for a job which never got as far as running.
+func failedToStart(c *Command, err error) {
+	c.EndTime = time.Now()
+	c.RunTime = c.EndTime.Sub(c.StartTime)
+	c.RunTimePrintable = c.RunTime.String()
+	c.Status = Errored
+	c.ReturnCode = -1
+	c.Error = err.Error()
+	c.Stdout, c.Stderr = []string{}, []string{}
+}
+
+// commandLine works out the argv for a job.  Without a shell that's the command split up into words,
+// with one it's the shell's own argv with the whole command tacked on the end, e.g. /bin/sh -c "...".
+func commandLine(substituted string, shell string) ([]string, error) {
+	if shell == "" {
+		return splitCommand(substituted)
+	}
+
+	if strings.TrimSpace(substituted) == "" {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	sh, err := splitCommand(shell)
+	if err != nil {
+		return nil, fmt.Errorf("bad --shell %q: %w", shell, err)
+	}
+
+	return append(sh, substituted), nil
 }
 
 // TODO don't pass in cmdList, just its length.
@@ -259,13 +554,36 @@ func getPBar(cmdListLen int, flags Flags) *progressbar.ProgressBar {
 
 }
 
-func commandLoop(loopCtx context.Context, loopCancel context.CancelFunc, commandsToRun CommandList, flags Flags) (CommandList, time.Duration) {
+func commandLoop(loopCtx context.Context, loopCancel context.CancelFunc, commandsToRun CommandList, flags Flags) (CommandList, time.Duration, string) {
+	return runLoop(loopCtx, loopCancel, feed(commandsToRun), len(commandsToRun), flags)
+}
 
-	var tokens = make(chan struct{}, flags.GoroutineLimit) // permission to run
-	var done = make(chan *Command)                         // where a command goes when it's done
-	var completedCommands CommandList                      // count all the done processes
+// feed hands out commands one at a time for runLoop.  It keeps going after the run's over so
+// runLoop can account for every job, started or not.
+func feed(cl CommandList) <-chan *Command {
+	source := make(chan *Command)
+
+	go func() {
+		defer close(source)
+		for _, c := range cl {
+			source <- c
+		}
+	}()
+
+	return source
+}
+
+// runLoop starts jobs as they come in from source, no more than flags.GoroutineLimit at once, and
+// collects them as they finish.  total is how many jobs there are going to be, -1 if that's not
+// known up front.  Once loopCtx is done, running jobs are killed and anything still to come from
+// source comes back NotStarted.  If --halt stops the run, anything left comes back Skipped and
+// the halt is returned.
+func runLoop(loopCtx context.Context, loopCancel context.CancelFunc, source <-chan *Command, total int, flags Flags) (CommandList, time.Duration, string) {
+
+	var slots = make(chan int, flags.GoroutineLimit) // permission to run, and which worker slot we're in
+	var done = make(chan *Command)                   // where a command goes when it's done
+	var running sync.WaitGroup                       // so we know when to close done
 	var pbarFinish time.Duration
-	var completionCount int
 
 	// small fixed delay after printing the end of the pbar so we can see that it hit 100%
 	if flags.Pbar {
@@ -273,70 +591,143 @@ func commandLoop(loopCtx context.Context, loopCancel context.CancelFunc, command
 	}
 
 	// a jobcount pbar, doesn't print anything unless flags.Pbar is set
-	pbar := getPBar(len(commandsToRun), flags)
+	pbar := getPBar(total, flags)
 
-	// launch all goroutines
+	rules, _ := parseRetryOn(flags.RetryOn) // already checked by Do
+	halt, _ := parseHalt(flags.Halt)
 
-	for _, c := range commandsToRun {
+	// --halt soon stops jobs starting without killing the ones already going
+	launchCtx, stopLaunching := context.WithCancelCause(loopCtx)
+	defer stopLaunching(nil)
 
-		go func() {
-			tokens <- struct{}{} // get permission to start
+	for i := 1; i <= flags.GoroutineLimit; i++ {
+		slots <- i
+	}
 
-			// create jobCtx and pass it in
-			// workerCtx, workerCancel := context.WithTimeout(mainCtx, 5*time.Second)
+	// launch goroutines as slots free up
 
-			// TODO: what if flags.JobTimeout is zero?  need magic here?
-			//   duration is int64 so just set it to that? 290 years.
-			jobCtx, jobCancel := context.WithTimeout(loopCtx, flags.JobTimeout)
-			c.JobTimeout = flags.JobTimeout
+	go func() {
+		defer func() {
+			running.Wait()
+			close(done)
+		}()
 
-			executeSingleCommand(jobCtx, jobCancel, c)
-			c.EndTime = time.Now()
-			c.RunTime = c.EndTime.Sub(c.StartTime)
-			c.RunTimePrintable = c.RunTime.Round(100 * time.Microsecond).String()
+		next := func() (*Command, bool) {
+			if total >= 0 {
+				c, ok := <-source
+				return c, ok
+			}
+			// --pipe, the next chunk can be a long time coming and once nothing's starting any
+			// more it isn't wanted
+			select {
+			case c, ok := <-source:
+				return c, ok
+			case <-launchCtx.Done():
+				return nil, false
+			}
+		}
 
-			done <- c // report status.
-			<-tokens  // return token when done.
-		}()
-	}
+		for c, ok := next(); ok; c, ok = next() {
+			var slot int
+			select {
+			case slot = <-slots: // get permission to start
+			case <-launchCtx.Done():
+			}
+
+			if launchCtx.Err() != nil {
+				if slot != 0 {
+					slots <- slot
+				}
+				c.Status = NotStarted
+				if context.Cause(launchCtx) == errHalted {
+					c.Status = Skipped
+				}
+				c.ReturnCode = -1
+				c.Stdout, c.Stderr = []string{}, []string{}
+				c.StdinData = nil
+				done <- c
+				if total < 0 {
+					// --pipe, don't read any more input than we already have
+					return
+				}
+				continue
+			}
+
+			running.Add(1)
+			go func() {
+				defer running.Done()
+
+				c.Slot = slot
+				c.Substituted = strings.ReplaceAll(c.Substituted, SlotToken, strconv.Itoa(slot))
+				c.EnvVars = concurEnv(c, total, flags)
+
+				runJob(loopCtx, c, rules, flags)
+				c.StdinData = nil // a --pipe chunk can be big, don't hang on to it
+				c.EndTime = time.Now()
+				c.RunTime = c.EndTime.Sub(c.StartTime)
+				c.RunTimePrintable = c.RunTime.Round(100 * time.Microsecond).String()
+
+				done <- c // report status, the slot's given back once that's been looked at
+			}()
+		}
+	}()
 
 	// collect all goroutines
 
 	doneList := CommandList{}
-Outer:
-	for completionCount != len(commandsToRun) {
-		select {
-		case c := <-done:
-			completionCount += 1
-			doneList = append(doneList, c)
-			pbar.Add(1)
-			if flags.FirstZero || (flags.Any && c.ReturnCode == 0) {
-				// slog.Debug(fmt.Sprintf("returning %s", c.Arg))
-				// this only returns the single command we're interested in regardless of what other commands have done.
-				//  TODO is this what I want?  or do I want to return all commands but the other ones as NotStarted / whatever?
-				// TODO: do I need to cancel all child contexts?  cancel the parent?  probably parent.
-				break Outer
+	var winner *Command
+	var halted string
+	for c := range done {
+		doneList = append(doneList, c)
+		pbar.Add(1)
+
+		if halted == "" && halt.record(c, total) {
+			halted = flags.Halt
+			stopLaunching(errHalted)
+			if halt.now {
+				notice(flags, "halting, %v (--halt %v)", halt.reason(), flags.Halt)
+				loopCancel()
+			} else {
+				notice(flags, "halting, %v (--halt %v), waiting for running jobs", halt.reason(), flags.Halt)
+			}
+		}
+
+		// a job that was cancelled or timed out didn't finish first, it was just stopped first
+		if winner == nil && (c.Status == Finished || c.Status == Errored) && (flags.FirstZero || (flags.Any && c.ReturnCode == 0)) {
+			winner = c
+			winner.Winner = true
+			if !flags.KeepRunning {
+				// got what we came for, everything else can stop
+				loopCancel()
 			}
+		}
 
-		case <-loopCtx.Done():
-			//fmt.Fprintf(os.Stderr, "global timeout popped, %v jobs done", len(completedCommands))
-			slog.Info(fmt.Sprintf("global timeout popped, %v jobs done", len(completedCommands)))
-			break Outer
+		// only now, so nothing new can start between a winner finishing and everything being cancelled
+		if c.Status != NotStarted && c.Status != Skipped {
+			slots <- c.Slot
 		}
 	}
-	// Outer: breaks here
+
+	if err := loopCtx.Err(); err == context.DeadlineExceeded {
+		slog.Info(fmt.Sprintf("global timeout popped, %v jobs done", len(doneList)))
+	}
 
 	loopCancel() // is this it?
 
-	// sort doneList by completion time so .commands[0] is the fastest.
-	sort.Slice(doneList, func(i int, j int) bool {
-		return doneList[i].RunTime < doneList[j].RunTime
-	})
+	// sort doneList by --sort, completion time by default so .commands[0] is the fastest.
+	sortCommands(doneList, flags.Sort)
+
+	// except that whatever --any or --first found always comes first
+	if winner != nil {
+		i := slices.Index(doneList, winner)
+		copy(doneList[1:i+1], doneList[:i])
+		doneList[0] = winner
+	}
 
 	pbar.Finish()          // don't know if I need this.
 	time.Sleep(pbarFinish) // to let the pbar finish displaying.
 
-	return doneList, pbarFinish
+	return doneList, pbarFinish, halted
 }
 
 func setTimeouts(globalTimeoutString, jobTimeoutString string) (time.Duration, time.Duration, error) {
@@ -400,12 +791,135 @@ func PopulateFlags(cmd *cobra.Command) Flags {
 
 	flags.Token, _ = cmd.Flags().GetString("token")
 	slog.Debug(fmt.Sprintf("token is %q", flags.Token))
+	flags.ColumnDelimiter, _ = cmd.Flags().GetString("colsep")
+	flags.TemplateEngine, _ = cmd.Flags().GetString("template-engine")
+	// --shell-cmd on its own is as good as --shell
+	if shell, _ := cmd.Flags().GetBool("shell"); shell || cmd.Flags().Changed("shell-cmd") {
+		flags.Shell, _ = cmd.Flags().GetString("shell-cmd")
+	}
+	flags.MaxArgs, _ = cmd.Flags().GetInt("max-args")
+	flags.StdinFile, _ = cmd.Flags().GetString("stdin-file")
+	flags.Pipe, _ = cmd.Flags().GetBool("pipe")
+	if block, _ := cmd.Flags().GetString("block"); block != "" {
+		if flags.BlockSize, err = parseSize(block); err != nil {
+			slog.Error(fmt.Sprintf("Invalid block size: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	if recend, _ := cmd.Flags().GetString("recend"); recend != "" {
+		// let people type \n and \0 on the command line
+		if flags.RecordEnd, err = strconv.Unquote(`"` + recend + `"`); err != nil {
+			slog.Error(fmt.Sprintf("Invalid record end: %q\n", recend))
+			os.Exit(1)
+		}
+	}
+	flags.Reassemble, _ = cmd.Flags().GetString("reassemble")
+	if env, _ := cmd.Flags().GetStringArray("env"); len(env) > 0 {
+		flags.Env = env
+	}
+	flags.EnvFile, _ = cmd.Flags().GetString("env-file")
+	flags.CleanEnv, _ = cmd.Flags().GetBool("clean-env")
+	flags.RecordEnv, _ = cmd.Flags().GetBool("record-env")
+	flags.KillSignal, _ = cmd.Flags().GetString("kill-signal")
+	if _, err := parseSignal(flags.KillSignal); err != nil {
+		slog.Error(fmt.Sprintf("Invalid kill signal: %v\n", err))
+		os.Exit(1)
+	}
+	if grace, _ := cmd.Flags().GetString("kill-grace"); grace != "" {
+		if flags.KillGrace, err = time.ParseDuration(grace); err != nil {
+			slog.Error(fmt.Sprintf("Invalid kill grace: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	flags.Retries, _ = cmd.Flags().GetInt("retries")
+	if delay, _ := cmd.Flags().GetString("retry-delay"); delay != "" {
+		if flags.RetryDelay, err = time.ParseDuration(delay); err != nil {
+			slog.Error(fmt.Sprintf("Invalid retry delay: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	if retryOn, _ := cmd.Flags().GetStringArray("retry-on"); len(retryOn) > 0 {
+		flags.RetryOn = retryOn
+		if _, err := parseRetryOn(retryOn); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if maxOutput, _ := cmd.Flags().GetString("max-output"); maxOutput != "" && maxOutput != "0" {
+		if flags.MaxOutput, err = parseSize(maxOutput); err != nil {
+			slog.Error(fmt.Sprintf("Invalid max output: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	if maxTotal, _ := cmd.Flags().GetString("max-output-total"); maxTotal != "" && maxTotal != "0" {
+		if flags.MaxOutputTotal, err = parseSize(maxTotal); err != nil {
+			slog.Error(fmt.Sprintf("Invalid max output total: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	if spill, _ := cmd.Flags().GetString("spill"); spill != "" && spill != "0" {
+		if flags.Spill, err = parseSize(spill); err != nil {
+			slog.Error(fmt.Sprintf("Invalid spill size: %v\n", err))
+			os.Exit(1)
+		}
+	}
+	flags.ResultsDir, _ = cmd.Flags().GetString("results-dir")
+	flags.OutputMode, _ = cmd.Flags().GetString("output-mode")
+	if err := checkOutputMode(flags.OutputMode); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	flags.Halt, _ = cmd.Flags().GetString("halt")
+	if _, err := parseHalt(flags.Halt); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	flags.Seed, _ = cmd.Flags().GetInt64("seed")
+	flags.NoShuffle, _ = cmd.Flags().GetBool("no-shuffle")
+	flags.Sort, _ = cmd.Flags().GetString("sort")
+	if err := checkSort(flags.Sort); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	flags.Workdir, _ = cmd.Flags().GetString("workdir")
+	flags.KeepTmp, _ = cmd.Flags().GetBool("keep-tmp")
+	flags.StdinTemplate, _ = cmd.Flags().GetString("stdin-template")
+	if err := checkStdinFlags(flags); err != nil {
+		slog.Error(fmt.Sprintf("%v", err))
+		os.Exit(1)
+	}
+	flags.Lines, _ = cmd.Flags().GetBool("lines")
+	flags.Null, _ = cmd.Flags().GetBool("null")
+	flags.InputDelimiter, _ = cmd.Flags().GetString("delimiter")
+	flags.NoSkip, _ = cmd.Flags().GetBool("no-skip")
+	flags.Expand, _ = cmd.Flags().GetBool("expand")
+	flags.ExpandLimit, _ = cmd.Flags().GetInt("expand-limit")
+	flags.CIDRHosts, _ = cmd.Flags().GetBool("cidr-hosts")
+	flags.TargetsFile, _ = cmd.Flags().GetString("targets-file")
+	if lists, _ := cmd.Flags().GetStringArray("list"); len(lists) > 0 {
+		flags.Lists = lists
+	}
+	flags.Zip, _ = cmd.Flags().GetBool("zip")
+	flags.Unique, _ = cmd.Flags().GetBool("unique")
+	if exclude, _ := cmd.Flags().GetStringArray("exclude"); len(exclude) > 0 {
+		flags.Exclude = exclude
+	}
+	flags.ExcludeFile, _ = cmd.Flags().GetString("exclude-file")
+	flags.IncludeRegex, _ = cmd.Flags().GetString("include-regex")
+	flags.ZipShortest, _ = cmd.Flags().GetBool("zip-shortest")
+	switch flags.TemplateEngine {
+	case "", "simple", "go":
+	default:
+		slog.Error(fmt.Sprintf("Invalid template engine: %q\n", flags.TemplateEngine))
+		os.Exit(1)
+	}
 	flags.FlagErrors, _ = cmd.Flags().GetBool("flag-errors")
 	flags.FirstZero, _ = cmd.Flags().GetBool("first")
 	flags.Pbar, _ = cmd.Flags().GetBool("pbar")
 	flags.LogLevel, _ = cmd.Flags().GetString("log")
 
 	flags.Any, _ = cmd.Flags().GetBool("any")
+	flags.KeepRunning, _ = cmd.Flags().GetBool("keep-running")
 
 	// TODO: break this into a separate function
 	flags.ConcurrentJobLimit, _ = cmd.Flags().GetString("concurrent")
@@ -436,17 +950,88 @@ func PopulateFlags(cmd *cobra.Command) Flags {
 	return flags
 }
 
-func buildListOfCommands(command string, targets []string, token string) (CommandList, error) {
-	// TODO I don't need a full template engine but should probably have something cooler than this.
+func buildListOfCommands(command string, targets []target, flags Flags) (CommandList, error) {
 
 	var ret CommandList
 	var id JobID
+	var err error
+
+	if flags.MaxArgs > 0 {
+		if err := checkStdinFlags(flags); err != nil {
+			return nil, err
+		}
+		ret, err = buildBatchedCommands(command, targets, flags)
+		if err != nil {
+			return nil, err
+		}
+		shuffle(ret, flags)
+		return ret, nil
+	}
+
+	if err := checkStdinFlags(flags); err != nil {
+		return nil, err
+	}
+
+	render, err := newRenderer(command, flags)
+	if err != nil {
+		return nil, err
+	}
+	env := environ()
 
-	for _, target := range targets {
-		slog.Debug(fmt.Sprintf("buildListOfCommands: target %q", target))
+	var renderStdin func(jobData) (string, string, error)
+	if flags.StdinTemplate != "" {
+		if renderStdin, err = newStdinRenderer(flags); err != nil {
+			return nil, err
+		}
+	}
+
+	renderEnv, err := newEnvRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	renderWorkdir, err := newWorkdirRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range targets {
+		slog.Debug(fmt.Sprintf("buildListOfCommands: target %q", t.Value))
 		x := Command{}
-		x.Arg = target
-		x.Substituted = strings.ReplaceAll(command, token, target)
+		x.Arg = t.Fields
+		if x.Arg == nil {
+			x.Arg = splitTarget(t.Value, flags.ColumnDelimiter)
+		}
+		if len(t.Vars) > 0 {
+			x.Vars = t.Vars
+		}
+
+		d := jobData{Target: t.Value, Fields: x.Arg, Vars: t.Vars, ID: id, Seq: int(id) + 1, Env: env}
+		substituted, err := render(d)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Value, err)
+		}
+
+		if renderStdin != nil {
+			if x.Stdin, x.StdinFile, err = renderStdin(d); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Value, err)
+			}
+		}
+
+		if renderEnv != nil {
+			if x.EnvVars, err = renderEnv(d); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Value, err)
+			}
+		}
+
+		if renderWorkdir != nil {
+			if x.Dir, err = renderWorkdir(d); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Value, err)
+			}
+		}
+
+		x.Substituted = substituted
+		x.Target = t.Value
 		x.Status = TBD
 		x.ID = id
 
@@ -455,11 +1040,7 @@ func buildListOfCommands(command string, targets []string, token string) (Comman
 		ret = append(ret, &x)
 	}
 
-	// mix them up just so there's no ordering dependency if they all take about the same time. otherwise the first one in the list
-	//   tends to be the one we return first with --any.
-	rand.Shuffle(len(ret), func(i, j int) {
-		ret[i], ret[j] = ret[j], ret[i]
-	})
+	shuffle(ret, flags)
 
 	slog.Debug(fmt.Sprintf("buildListOfCommands: returning %q %v", ret, nil))
 	return ret, nil
@@ -11,7 +11,7 @@ import (
 
 // TODO
 func Test_executeSingleCommand(t *testing.T) {
-	// func executeSingleCommand(jobCtx context.Context, jobCancel context.CancelFunc, c *Command)
+	// func executeSingleCommand(jobCtx context.Context, jobCancel context.CancelFunc, c *Command, flags Flags)
 
 	t.Parallel()
 	// needs from c: Substituted. and it fiddles with stuff on the way back in.
@@ -21,7 +21,7 @@ func Test_executeSingleCommand(t *testing.T) {
 		Substituted: "echo hello",
 	}
 
-	executeSingleCommand(ctx, ctxCancel, &c)
+	executeSingleCommand(ctx, ctxCancel, &c, Flags{})
 
 	// now what?  sanity check stuff
 
@@ -37,7 +37,7 @@ func Test_executeSingleCommand(t *testing.T) {
 		t.Errorf("return code from echo should be 0 but is instead %v", c.ReturnCode)
 	}
 
-	if c.Stdout[0] != "hello" || len(c.Stdout) != 2 { // len 2 because newline is a separate slice item
+	if c.Stdout[0] != "hello" || len(c.Stdout) != 1 {
 		t.Errorf("stdout is wonky: %q", c.Stdout)
 	}
 
@@ -69,13 +69,13 @@ func Test_commandLoop(t *testing.T) {
 			ID:          0,
 			Status:      TBD,
 			Substituted: "echo hello",
-			Arg:         "hello",
+			Arg:         []string{"hello"},
 		}, // command
 		&Command{
 			ID:          0,
 			Status:      TBD,
 			Substituted: "ping -c 1 www.mit.edu",
-			Arg:         "www.mit.edu",
+			Arg:         []string{"www.mit.edu"},
 		},
 	} //CommandList
 
@@ -85,7 +85,7 @@ func Test_commandLoop(t *testing.T) {
 		GoroutineLimit: len(cmdList),
 	}
 
-	resList, runtime := commandLoop(ctx, ctxCancel, cmdList, flags)
+	resList, runtime, _ := commandLoop(ctx, ctxCancel, cmdList, flags)
 	// t.Log(resList, runtime)
 	//  not sure what else to check in these two here
 	if runtime < 0 {
@@ -171,7 +171,8 @@ func Test_buildListOfCommands(t *testing.T) {
 					ID:          0,
 					Status:      TBD,
 					Substituted: "echo hello",
-					Arg:         "hello",
+					Target:      "hello",
+					Arg:         []string{"hello"},
 				}, // command
 			}, //command list
 		}, // first test case
@@ -184,14 +185,43 @@ func Test_buildListOfCommands(t *testing.T) {
 					ID:          0,
 					Status:      TBD,
 					Substituted: "ping www.mit.edu",
-					Arg:         "www.mit.edu",
+					Target:      "www.mit.edu",
+					Arg:         []string{"www.mit.edu"},
+				},
+			},
+		},
+		{ // two columns, default delimiter
+			command: "scp {{1}} {{2}}:/flash/",
+			targets: []string{"fw.bin r1"},
+			token:   "{{1}}",
+			expected: CommandList{
+				&Command{
+					ID:          0,
+					Status:      TBD,
+					Substituted: "scp fw.bin r1:/flash/",
+					Target:      "fw.bin r1",
+					Arg:         []string{"fw.bin", "r1"},
+				},
+			},
+		},
+		{ // columns can be reused and reordered
+			command: "echo {{2}} {{1}} {{2}}",
+			targets: []string{"a,b"},
+			token:   "{{1}}",
+			expected: CommandList{
+				&Command{
+					ID:          0,
+					Status:      TBD,
+					Substituted: "echo b a b",
+					Target:      "a,b",
+					Arg:         []string{"a", "b"},
 				},
 			},
 		},
 	}
 
 	for _, tc := range testCases {
-		got, err := buildListOfCommands(tc.command, tc.targets, tc.token)
+		got, err := buildListOfCommands(tc.command, targetsFromStrings(tc.targets), Flags{Token: tc.token})
 		if err != nil {
 			t.Errorf("got some sort of error from buildListOfCommands %q", err)
 		}
@@ -202,3 +232,284 @@ func Test_buildListOfCommands(t *testing.T) {
 
 	}
 }
+
+func Test_buildListOfCommands_columns(t *testing.T) {
+
+	t.Parallel()
+	testCases := []struct {
+		command    string
+		target     string
+		delimiter  string
+		expected   string
+		expectPass bool
+	}{
+		{command: "echo {{1}}-{{2}}", target: "a\tb", expected: "echo a-b", expectPass: true},
+		{command: "echo {{1}}-{{2}}", target: "a b,c", delimiter: ",", expected: "echo 'a b'-c", expectPass: true},
+		{command: "echo {{3}}", target: "a b", expectPass: false},
+		{command: "echo {{1}}", target: "", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := buildListOfCommands(tc.command, targetsFromStrings([]string{tc.target}), Flags{Token: DefaultToken, ColumnDelimiter: tc.delimiter})
+
+		if tc.expectPass == false {
+			if err == nil {
+				t.Errorf("no error seen when there should be one with %q %q", tc.command, tc.target)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q %q", err, tc.command, tc.target)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got[0].Substituted); diff != "" {
+			t.Errorf("diff\n%s", diff)
+		}
+	}
+}
+
+func Test_buildListOfCommands_goTemplate(t *testing.T) {
+
+	// no t.Parallel() here, t.Setenv doesn't allow it
+	t.Setenv("CONCUR_TEST_SITE", "dc1")
+
+	testCases := []struct {
+		command    string
+		target     string
+		expected   string
+		expectPass bool
+	}{
+		{command: "echo {{ .Target | upper }}", target: "r1", expected: "echo R1", expectPass: true},
+		{command: "echo {{ index .Fields 1 }}", target: "fw.bin r1", expected: "echo r1", expectPass: true},
+		{command: "echo {{ .ID }}", target: "r1", expected: "echo 0", expectPass: true},
+		{command: `cp {{ .Target }} {{ .Target | base | trimSuffix ".bin" }}.bak`, target: "/tmp/fw.bin", expected: "cp /tmp/fw.bin fw.bak", expectPass: true},
+		{command: `echo {{ env "CONCUR_TEST_SITE" }} {{ .Env.CONCUR_TEST_SITE | lower }}`, target: "x", expected: "echo dc1 dc1", expectPass: true},
+		{command: `echo {{ env "CONCUR_TEST_NOPE" | default "none" }}`, target: "x", expected: "echo none", expectPass: true},
+		{command: `echo {{ index (split "." .Target) 0 }} {{ .Target | replace "." "-" }}`, target: "a.b", expected: "echo a a-b", expectPass: true},
+		{command: "echo {{ .Target ", target: "x", expectPass: false},          // parse error
+		{command: "echo {{ .Nope }}", target: "x", expectPass: false},          // no such field
+		{command: "echo {{ nofunc .Target }}", target: "x", expectPass: false}, // no such function
+	}
+
+	for _, tc := range testCases {
+		got, err := buildListOfCommands(tc.command, targetsFromStrings([]string{tc.target}), Flags{TemplateEngine: "go"})
+
+		if tc.expectPass == false {
+			if err == nil {
+				t.Errorf("no error seen when there should be one with %q", tc.command)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.command)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got[0].Substituted); diff != "" {
+			t.Errorf("diff\n%s", diff)
+		}
+	}
+}
+
+func Test_checkTemplateNotTarget(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		command    string
+		targets    []string
+		token      string
+		expectPass bool
+	}{
+		{command: "/bin/bash -c", targets: []string{"echo {{1}}", "a"}, token: DefaultToken, expectPass: false},
+		{command: "bash -c", targets: []string{"echo @@", "a"}, token: "@@", expectPass: false},
+		{command: "echo {{1}}", targets: []string{"a", "b"}, token: DefaultToken, expectPass: true},
+		{command: "ping -c 1 @@", targets: []string{"a"}, token: "@@", expectPass: true},
+		{command: "uptime", targets: []string{"a", "b"}, token: DefaultToken, expectPass: true},
+		{command: "uptime", targets: nil, token: DefaultToken, expectPass: true},
+	}
+
+	for _, tc := range testCases {
+		err := checkTemplateNotTarget(tc.command, tc.targets, Flags{Token: tc.token})
+		if tc.expectPass && err != nil {
+			t.Errorf("error %q when there should be none with %q %q", err, tc.command, tc.targets)
+		}
+		if !tc.expectPass && err == nil {
+			t.Errorf("no error when there should be one with %q %q", tc.command, tc.targets)
+		}
+	}
+}
+
+func Test_buildListOfCommands_goTemplateShell(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		command  string
+		target   string
+		expected string
+	}{
+		{command: "echo {{ .Target }}", target: "foo; echo INJECTED", expected: "echo 'foo; echo INJECTED'"},
+		{command: `echo {{ .Target | trimSuffix ".bin" }}`, target: "my fw.bin", expected: "echo 'my fw'"},
+		{command: "echo {{ .Target | shquote }} {{ shquote .Target }}", target: "a b", expected: "echo 'a b' 'a b'"},
+		{command: "echo {{ .Target | raw }}", target: "a; b", expected: "echo a; b"},
+		{command: "echo {{ range .Fields }}{{ . }} {{ end }}", target: "a b,c", expected: "echo 'a b' c "},
+		{command: "{{ $t := .Target }}echo {{ $t }}", target: "$(reboot)", expected: "echo '$(reboot)'"},
+	}
+
+	for _, tc := range testCases {
+		flags := Flags{TemplateEngine: "go", Shell: DefaultShell, ColumnDelimiter: ","}
+		got, err := buildListOfCommands(tc.command, targetsFromStrings([]string{tc.target}), flags)
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.command)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got[0].Substituted); diff != "" {
+			t.Errorf("%q diff\n%s", tc.command, diff)
+		}
+	}
+}
+
+func Test_buildListOfCommands_modifiers(t *testing.T) {
+
+	t.Parallel()
+	testCases := []struct {
+		command  string
+		target   string
+		expected string
+	}{
+		{command: "echo {{1.}}", target: "dir/img.jpg", expected: "echo dir/img"},
+		{command: "echo {{1/}}", target: "dir/img.jpg", expected: "echo img.jpg"},
+		{command: "echo {{1//}}", target: "dir/img.jpg", expected: "echo dir"},
+		{command: "echo {{1/.}}", target: "dir/img.jpg", expected: "echo img"},
+		{command: "echo {{1/.}}", target: "dir.d/img", expected: "echo img"},
+		{command: "echo {{2/}}", target: "a dir/b.txt", expected: "echo b.txt"},
+		{command: "convert {{1}} out/{{1/.}}.png", target: "in/cat.jpg", expected: "convert in/cat.jpg out/cat.png"},
+		{command: "echo {{#}} {{%}}", target: "x", expected: "echo 1 {{%}}"}, // slot is filled in at run time
+	}
+
+	for _, tc := range testCases {
+		got, err := buildListOfCommands(tc.command, targetsFromStrings([]string{tc.target}), Flags{Token: DefaultToken})
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q %q", err, tc.command, tc.target)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got[0].Substituted); diff != "" {
+			t.Errorf("diff\n%s", diff)
+		}
+	}
+}
+
+func Test_commandLoop_slots(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	cmdList, _ := buildListOfCommands("echo {{#}} {{%}}", targetsFromStrings([]string{"a", "b", "c"}), Flags{Token: DefaultToken})
+
+	flags := Flags{
+		JobTimeout:     time.Duration(5 * time.Second),
+		GoroutineLimit: 2,
+	}
+
+	resList, _, _ := commandLoop(ctx, ctxCancel, cmdList, flags)
+
+	for _, cmd := range resList {
+		if cmd.Slot < 1 || cmd.Slot > flags.GoroutineLimit {
+			t.Errorf("slot %v out of range for job %v", cmd.Slot, cmd.ID)
+		}
+
+		want := fmt.Sprintf("%v %v", cmd.ID+1, cmd.Slot)
+		if cmd.Stdout[0] != want {
+			t.Errorf("expected stdout %q but got %q", want, cmd.Stdout[0])
+		}
+	}
+}
+
+func Test_commandLoop_any(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		flags    Flags
+		expected map[string]JobStatus // by target
+	}{
+		{
+			name:     "losers are cancelled",
+			flags:    Flags{Any: true, GoroutineLimit: 2, NoShuffle: true},
+			expected: map[string]JobStatus{"0": Finished, "30": Cancelled, "31": NotStarted},
+		},
+		{
+			name:     "first doesn't care about exit codes",
+			flags:    Flags{FirstZero: true, GoroutineLimit: 2, NoShuffle: true},
+			expected: map[string]JobStatus{"0": Finished, "30": Cancelled, "31": NotStarted},
+		},
+		{
+			name:     "keep running",
+			flags:    Flags{Any: true, KeepRunning: true, GoroutineLimit: 3, NoShuffle: true},
+			expected: map[string]JobStatus{"0": Finished, "0.2": Finished, "0.3": Finished},
+		},
+	}
+
+	for _, tc := range testCases {
+		targets := []string{"30", "0", "31"}
+		if tc.flags.KeepRunning {
+			targets = []string{"0.3", "0", "0.2"}
+		}
+
+		tc.flags.Token = DefaultToken
+		tc.flags.JobTimeout = time.Minute
+		cmdList, err := buildListOfCommands("sleep {{1}}", targetsFromStrings(targets), tc.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		start := time.Now()
+		resList, _, _ := commandLoop(ctx, ctxCancel, cmdList, tc.flags)
+
+		if time.Since(start) > 10*time.Second {
+			t.Errorf("%v: losers weren't killed promptly", tc.name)
+		}
+
+		got := map[string]JobStatus{}
+		for _, c := range resList {
+			got[c.Target] = c.Status
+		}
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%v: status diff\n%s", tc.name, diff)
+		}
+
+		if len(resList) > 0 && (resList[0].Target != "0" || !resList[0].Winner) {
+			t.Errorf("%v: the winner should come first, got %v", tc.name, resList[0].Target)
+		}
+	}
+}
+
+func Test_commandLoop_noWinner(t *testing.T) {
+
+	t.Parallel()
+
+	// the whole run's cancelled before anything's done, which doesn't make anything first
+	flags := Flags{FirstZero: true, GoroutineLimit: 2, Token: DefaultToken, JobTimeout: time.Minute, KillGrace: time.Second}
+	cmdList, err := buildListOfCommands("sleep {{1}}", targetsFromStrings([]string{"30", "31"}), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	resList, _, _ := commandLoop(ctx, ctxCancel, cmdList, flags)
+
+	for _, c := range resList {
+		if c.Winner {
+			t.Errorf("%v ended up %v, it shouldn't be the winner", c.Target, c.Status)
+		}
+	}
+}
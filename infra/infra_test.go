@@ -2,6 +2,7 @@ package infra_test
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,13 +29,16 @@ import (
 func TestDo(t *testing.T) {
 	// test with echoes
 
-	results := infra.Do("echo {{1}}", []string{"booger", "nose"}, infra.Flags{
+	results, err := infra.Do("echo {{1}}", []string{"booger", "nose"}, infra.Flags{
 		ConcurrentJobLimit: "128",
 		GoroutineLimit:     128,
 		Timeout:            time.Duration(90 * time.Second),
 		JobTimeout:         time.Duration(10 * time.Second),
 		Token:              "{{1}}",
 	})
+	if err != nil {
+		t.Fatalf("unexpected error from Do: %v", err)
+	}
 
 	for _, cmd := range results.Commands {
 		//t.Log("C", cmd)
@@ -51,6 +55,59 @@ func TestDo(t *testing.T) {
 
 }
 
+func TestDoBadTemplate(t *testing.T) {
+	// a template that doesn't parse should fail before anything runs
+
+	_, err := infra.Do("echo {{ .Target", []string{"booger"}, infra.Flags{
+		GoroutineLimit: 1,
+		JobTimeout:     time.Duration(10 * time.Second),
+		TemplateEngine: "go",
+	})
+
+	if err == nil {
+		t.Error("expected an error from a broken template")
+	}
+}
+
+func TestReadTargets(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		input      string
+		flags      infra.Flags
+		expected   []string
+		expectPass bool
+	}{
+		{input: "a b\n c", flags: infra.Flags{}, expected: []string{"a", "b", "c"}, expectPass: true},
+		{input: "my file.txt\r\n\n# skip me\n  other file\n", flags: infra.Flags{Lines: true}, expected: []string{"my file.txt", "  other file"}, expectPass: true},
+		{input: "a\n\n#b\n", flags: infra.Flags{Lines: true, NoSkip: true}, expected: []string{"a", "", "#b"}, expectPass: true},
+		{input: "x y\x00#z\x00", flags: infra.Flags{Null: true}, expected: []string{"x y"}, expectPass: true},
+		{input: "r1 one;r2 two", flags: infra.Flags{InputDelimiter: ";"}, expected: []string{"r1 one", "r2 two"}, expectPass: true},
+		{input: "", flags: infra.Flags{Lines: true}, expected: nil, expectPass: true},
+		{input: "a", flags: infra.Flags{Lines: true, Null: true}, expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := infra.ReadTargets(strings.NewReader(tc.input), tc.flags)
+
+		if tc.expectPass == false {
+			if err == nil {
+				t.Errorf("no error seen when there should be one with %q", tc.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.input)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%q diff\n%s", tc.input, diff)
+		}
+	}
+}
+
 func TestGetJSONReport(t *testing.T) {
 	t.Skip() // taken care of in TestDo()
 }
@@ -0,0 +1,79 @@
+package infra
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadTargets reads targets from r, usually stdin.  By default the input is split into words,
+// which is fine for hostnames but not for anything with a space in it, so there are also
+// --lines (one target per line), -0 (NUL separated, for find -print0) and --delimiter.  In
+// those modes blank entries and entries starting with # are skipped unless --no-skip is set.
+func ReadTargets(r io.Reader, flags Flags) ([]string, error) {
+	sep, err := inputSeparator(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading targets: %w", err)
+	}
+	str := string(b)
+
+	if sep == "" {
+		// .Fields() breaks the input string into separate words.
+		return strings.Fields(str), nil
+	}
+
+	// a trailing separator ends the last entry, it doesn't start an empty one
+	str = strings.TrimSuffix(str, sep)
+	if str == "" {
+		return nil, nil
+	}
+
+	var ret []string
+	for _, t := range strings.Split(str, sep) {
+		if sep == "\n" {
+			t = strings.TrimSuffix(t, "\r")
+		}
+
+		if !flags.NoSkip {
+			trimmed := strings.TrimSpace(t)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+		}
+
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// inputSeparator works out what separates targets from --lines, -0 and --delimiter.  "" means
+// split on whitespace.
+func inputSeparator(flags Flags) (string, error) {
+	var sep string
+	n := 0
+
+	if flags.Lines {
+		sep = "\n"
+		n++
+	}
+	if flags.Null {
+		sep = "\x00"
+		n++
+	}
+	if flags.InputDelimiter != "" {
+		sep = flags.InputDelimiter
+		n++
+	}
+
+	if n > 1 {
+		return "", fmt.Errorf("only one of --lines, -0 and --delimiter can be used")
+	}
+
+	return sep, nil
+}
@@ -0,0 +1,46 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// ExitInterrupted is what concur exits with after a Ctrl-C, same as a shell would.
+const ExitInterrupted = 130
+
+// catchInterrupts turns the first SIGINT or SIGTERM into cancel, so running jobs get killed the
+// usual way and whatever's done still gets reported.  A second one means the user really wants
+// out, so that exits on the spot.  stop puts signal handling back how it was.
+func catchInterrupts(cancel context.CancelFunc, flags Flags) (interrupted func() bool, stop func()) {
+	var caught atomic.Bool
+	sigs := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			caught.Store(true)
+			notice(flags, "got %v, stopping jobs; do it again to quit without waiting", sig)
+			cancel()
+		case <-quit:
+			return
+		}
+
+		select {
+		case <-sigs:
+			notice(flags, "quitting")
+			os.Exit(ExitInterrupted)
+		case <-quit:
+		}
+	}()
+
+	return caught.Load, func() {
+		signal.Stop(sigs)
+		close(quit)
+	}
+}
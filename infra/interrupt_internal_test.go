@@ -0,0 +1,36 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// not parallel, the signal would cancel anything else that's catching interrupts at the time
+func Test_catchInterrupts(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupted, stop := catchInterrupts(cancel, Flags{LogLevel: "q"})
+	defer stop()
+
+	if interrupted() {
+		t.Fatal("interrupted before anything happened")
+	}
+
+	p, _ := os.FindProcess(os.Getpid())
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Skipf("can't send ourselves an interrupt here: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("an interrupt should cancel the run")
+	}
+	if !interrupted() {
+		t.Error("should say it was interrupted")
+	}
+}
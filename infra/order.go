@@ -0,0 +1,91 @@
+package infra
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultSort is how Commands are ordered if --sort isn't given, fastest first.
+const DefaultSort = "runtime"
+
+// SortKeys are what --sort understands.
+var SortKeys = []string{"id", "target", "runtime", "status", "returncode", "start"}
+
+// newSeed picks a shuffle seed when there isn't one so any run can be repeated with --seed.
+func newSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// mix them up just so there's no ordering dependency if they all take about the same time. otherwise the first one in the list
+// tends to be the one we return first with --any.  The same seed always gives the same order.
+func shuffle(cl CommandList, flags Flags) {
+	if flags.NoShuffle {
+		return
+	}
+
+	r := rand.New(rand.NewSource(flags.Seed))
+	r.Shuffle(len(cl), func(i, j int) {
+		cl[i], cl[j] = cl[j], cl[i]
+	})
+}
+
+// checkSort makes sure --sort is something sortCommands knows about.
+func checkSort(key string) error {
+	if key != "" && !slices.Contains(SortKeys, key) {
+		return fmt.Errorf("invalid sort %q, want one of %v", key, strings.Join(SortKeys, ", "))
+	}
+	return nil
+}
+
+// sortCommands puts finished commands in --sort order, with any that never ran after all the
+// ones that did whatever the order.  Ties are broken by job ID so the order doesn't depend on
+// how things happened to finish.
+func sortCommands(cl CommandList, key string) {
+	var less func(a, b *Command) bool
+
+	switch key {
+	case "id":
+		less = func(a, b *Command) bool { return false }
+	case "target":
+		less = func(a, b *Command) bool { return commandTarget(a) < commandTarget(b) }
+	case "status":
+		less = func(a, b *Command) bool { return a.Status < b.Status }
+	case "returncode":
+		less = func(a, b *Command) bool { return a.ReturnCode < b.ReturnCode }
+	case "start":
+		less = func(a, b *Command) bool { return a.StartTime.Before(b.StartTime) }
+	default: // runtime, so .commands[0] is the fastest
+		less = func(a, b *Command) bool { return a.RunTime < b.RunTime }
+	}
+
+	sort.Slice(cl, func(i, j int) bool {
+		if ran(cl[i]) != ran(cl[j]) {
+			return ran(cl[i])
+		}
+		if less(cl[i], cl[j]) {
+			return true
+		}
+		if less(cl[j], cl[i]) {
+			return false
+		}
+		return cl[i].ID < cl[j].ID
+	})
+}
+
+// ran says whether a command got as far as starting.  One that didn't has no runtime to speak
+// of, and isn't the fastest of anything.
+func ran(c *Command) bool {
+	return c.Status != NotStarted && c.Status != Skipped
+}
+
+// commandTarget is what a command ran against for sorting, whatever sort of command it is.
+func commandTarget(c *Command) string {
+	if len(c.Targets) > 0 {
+		return strings.Join(c.Targets, " ")
+	}
+	return c.Target
+}
@@ -0,0 +1,82 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func ids(cl CommandList) []JobID {
+	var ret []JobID
+	for _, c := range cl {
+		ret = append(ret, c.ID)
+	}
+	return ret
+}
+
+func Test_shuffle(t *testing.T) {
+
+	t.Parallel()
+
+	targets := targetsFromStrings([]string{"a", "b", "c", "d", "e", "f", "g", "h"})
+
+	first, err := buildListOfCommands("echo {{1}}", targets, Flags{Token: DefaultToken, Seed: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := buildListOfCommands("echo {{1}}", targets, Flags{Token: DefaultToken, Seed: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ids(first), ids(second)); diff != "" {
+		t.Errorf("same seed should give the same order\n%s", diff)
+	}
+
+	inOrder, err := buildListOfCommands("echo {{1}}", targets, Flags{Token: DefaultToken, Seed: 42, NoShuffle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]JobID{0, 1, 2, 3, 4, 5, 6, 7}, ids(inOrder)); diff != "" {
+		t.Errorf("--no-shuffle should keep input order\n%s", diff)
+	}
+}
+
+func Test_sortCommands(t *testing.T) {
+
+	t.Parallel()
+
+	now := time.Now()
+	cl := CommandList{
+		&Command{ID: 0, Target: "c", RunTime: 3, Status: Finished, ReturnCode: 0, StartTime: now.Add(2)},
+		&Command{ID: 1, Target: "a", RunTime: 1, Status: TimedOut, ReturnCode: -1, StartTime: now.Add(3)},
+		&Command{ID: 2, Target: "b", RunTime: 2, Status: Errored, ReturnCode: 2, StartTime: now},
+		&Command{ID: 3, Targets: []string{"a", "z"}, RunTime: 1, Status: Finished, ReturnCode: 0, StartTime: now.Add(1)},
+		&Command{ID: 4, Target: "0", RunTime: 0, Status: NotStarted, ReturnCode: -1},
+	}
+
+	testCases := []struct {
+		key      string
+		expected []JobID
+	}{
+		{key: "", expected: []JobID{1, 3, 2, 0, 4}},
+		{key: "runtime", expected: []JobID{1, 3, 2, 0, 4}},
+		{key: "id", expected: []JobID{0, 1, 2, 3, 4}},
+		{key: "target", expected: []JobID{1, 3, 2, 0, 4}},
+		{key: "status", expected: []JobID{0, 3, 2, 1, 4}},
+		{key: "returncode", expected: []JobID{1, 0, 3, 2, 4}},
+		{key: "start", expected: []JobID{2, 3, 0, 1, 4}},
+	}
+
+	for _, tc := range testCases {
+		sorted := append(CommandList{}, cl...)
+		sortCommands(sorted, tc.key)
+		if diff := cmp.Diff(tc.expected, ids(sorted)); diff != "" {
+			t.Errorf("--sort %q diff\n%s", tc.key, diff)
+		}
+	}
+
+	if err := checkSort("bogus"); err == nil {
+		t.Error("expected an error with --sort bogus")
+	}
+}
@@ -0,0 +1,412 @@
+package infra
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// how --output-mode shows a job's stdout and stderr
+const (
+	OutputLines  = "lines"  // one string per line
+	OutputRaw    = "raw"    // all of it as one string
+	OutputBase64 = "base64" // all of it as one base64 string
+	OutputNone   = "none"   // not at all
+)
+
+// DefaultOutputMode is how output's shown if --output-mode isn't given.
+const DefaultOutputMode = OutputLines
+
+// OutputModes are what --output-mode understands.
+var OutputModes = []string{OutputLines, OutputRaw, OutputBase64, OutputNone}
+
+// checkOutputMode makes sure --output-mode is something render knows about.
+func checkOutputMode(mode string) error {
+	if mode != "" && !slices.Contains(OutputModes, mode) {
+		return fmt.Errorf("invalid output mode %q, want one of %v", mode, strings.Join(OutputModes, ", "))
+	}
+	return nil
+}
+
+// outputBudget is --max-output-total, how much output all the jobs in a run may hold in memory
+// between them.  It never comes back, the output's kept until the report's done.
+type outputBudget struct {
+	left atomic.Int64
+}
+
+type outputBudgetKey struct{}
+
+// withOutputBudget hangs the run's output budget off ctx so every job can get at it.  No
+// --max-output-total means no budget.
+func withOutputBudget(ctx context.Context, flags Flags) context.Context {
+	if flags.MaxOutputTotal <= 0 {
+		return ctx
+	}
+	b := &outputBudget{}
+	b.left.Store(int64(flags.MaxOutputTotal))
+	return context.WithValue(ctx, outputBudgetKey{}, b)
+}
+
+func budgetFrom(ctx context.Context) *outputBudget {
+	b, _ := ctx.Value(outputBudgetKey{}).(*outputBudget)
+	return b
+}
+
+// take hands out up to n bytes of what's left.  A nil budget never runs out.
+func (b *outputBudget) take(n int) int {
+	if b == nil {
+		return n
+	}
+	for {
+		left := b.left.Load()
+		got := min(int64(n), max(left, 0))
+		if b.left.CompareAndSwap(left, left-got) {
+			return int(got)
+		}
+	}
+}
+
+// give hands back output that's gone to disk.
+func (b *outputBudget) give(n int) {
+	if b != nil {
+		b.left.Add(int64(n))
+	}
+}
+
+// spillDir is where output that's passed --spill goes, --results-dir or a temp directory made
+// the first time a job needs it.
+type spillDir struct {
+	once sync.Once
+	dir  string
+	made bool
+	err  error
+}
+
+type spillDirKey struct{}
+
+// withSpillDir hangs the run's spill directory off ctx.  No --spill or --results-dir means
+// output all stays in memory.
+func withSpillDir(ctx context.Context, flags Flags) context.Context {
+	if flags.Spill <= 0 && flags.ResultsDir == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, spillDirKey{}, &spillDir{dir: flags.ResultsDir})
+}
+
+func spillDirFrom(ctx context.Context) *spillDir {
+	s, _ := ctx.Value(spillDirKey{}).(*spillDir)
+	return s
+}
+
+// where is the spill directory if anything's been spilled into it.  Only once the jobs are done.
+func (s *spillDir) where() string {
+	if s == nil || !s.made {
+		return ""
+	}
+	return s.dir
+}
+
+// create makes the file one of a job's streams is spilled to, e.g. 12.stdout.
+func (s *spillDir) create(c *Command, stream string, flags Flags) (*os.File, error) {
+	s.once.Do(func() {
+		if s.dir == "" {
+			s.dir, s.err = os.MkdirTemp("", "concur-output-")
+			if s.err == nil {
+				notice(flags, "spilling job output to %v", s.dir)
+			}
+		} else {
+			s.err = os.MkdirAll(s.dir, 0o755)
+		}
+		s.made = s.err == nil
+	})
+	if s.err != nil {
+		return nil, fmt.Errorf("results dir: %w", s.err)
+	}
+
+	return os.Create(filepath.Join(s.dir, fmt.Sprintf("%v.%v", c.ID, stream)))
+}
+
+// how long to wait for the rest of a job's output once it and its process group are gone, in
+// case something that got away from the group is still holding the pipe open
+const pipeDrainDelay = time.Second
+
+// jobPipe feeds a capture from a pipe the job writes to directly.  Handing exec a file rather
+// than a Writer means Wait comes back as soon as the job exits, not when the last thing it left
+// running lets go of its output, so those leftovers can be dealt with.
+type jobPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+func newJobPipe(dst io.Writer) (*jobPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("output pipe: %w", err)
+	}
+	p := &jobPipe{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		io.Copy(dst, r)
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// started closes our end of the pipe for writing, the job has its own.
+func (p *jobPipe) started() {
+	p.w.Close()
+}
+
+// finish waits for whatever's still in the pipe, for up to wait.
+func (p *jobPipe) finish(wait time.Duration) {
+	p.w.Close() // in case it never started
+	select {
+	case <-p.done:
+	case <-time.After(wait):
+		p.r.Close()
+		<-p.done
+	}
+	p.r.Close()
+}
+
+// how much of a spilled stream raw reads back
+const spillScan = 1 << 20
+
+// capture is where a job's stdout or stderr goes.  With --max-output it keeps the first and
+// last half of that many bytes and drops the middle, which is where the least interesting bit
+// of a huge log usually is.  Running out of --max-output-total stops it growing any further.
+type capture struct {
+	headMax int // -1 for no limit
+	tailMax int
+	budget  *outputBudget
+
+	head    []byte
+	tail    []byte // a ring once it's full
+	pos     int    // where the next tail byte goes
+	full    bool
+	written int64
+
+	spillAt int                      // move everything to a file once there's more than this
+	spill   func() (*os.File, error) // nil for never
+	file    *os.File
+}
+
+func newCapture(max int, budget *outputBudget) *capture {
+	if max <= 0 {
+		return &capture{headMax: -1, budget: budget}
+	}
+	return &capture{headMax: max - max/2, tailMax: max / 2, budget: budget}
+}
+
+// spillTo sends everything to the file create makes once there's more than after bytes of it.
+func (w *capture) spillTo(after int, create func() (*os.File, error)) {
+	w.spillAt, w.spill = after, create
+}
+
+func (w *capture) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if w.file == nil && w.spill != nil {
+		// nothing's dropped from a stream that can go to a file, it goes to the file instead,
+		// however small it is
+		if w.written+int64(n) <= int64(w.spillAt) && (w.headMax < 0 || len(w.head)+n <= w.headMax) {
+			got := w.budget.take(n)
+			if got == n {
+				w.written += int64(n)
+				w.head = append(w.head, p...)
+				return n, nil
+			}
+			w.budget.give(got)
+		}
+		w.spillNow()
+	}
+	w.written += int64(n)
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+
+	if w.headMax < 0 || len(w.head) < w.headMax {
+		want := len(p)
+		if w.headMax >= 0 {
+			want = min(want, w.headMax-len(w.head))
+		}
+		got := w.budget.take(want)
+		w.head = append(w.head, p[:got]...)
+		p = p[got:]
+		if got < want {
+			// out of budget, the head's as big as it's going to get
+			w.headMax = len(w.head)
+		}
+	}
+
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	if w.tail == nil {
+		w.tail = make([]byte, w.budget.take(w.tailMax))
+	}
+	size := len(w.tail)
+	if size == 0 {
+		return n, nil
+	}
+
+	if len(p) >= size {
+		copy(w.tail, p[len(p)-size:])
+		w.pos, w.full = 0, true
+		return n, nil
+	}
+	if w.pos+len(p) >= size {
+		w.full = true
+	}
+	copied := copy(w.tail[w.pos:], p)
+	copy(w.tail, p[copied:])
+	w.pos = (w.pos + len(p)) % size
+
+	return n, nil
+}
+
+// spillNow moves what's been kept so far into the spill file, which gets everything from here on.
+// If there's no file to be had it's all kept in memory, --max-output and all, like there was no
+// --spill.
+func (w *capture) spillNow() {
+	create := w.spill
+	w.spill = nil
+
+	f, err := create()
+	if err == nil {
+		_, err = f.Write(append(w.head, w.tailBytes()...))
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("can't spill output, keeping it in memory: %v", err))
+		if f != nil {
+			f.Close()
+		}
+		return
+	}
+
+	w.budget.give(len(w.head) + len(w.tail))
+	w.file = f
+	w.head, w.tail, w.pos, w.full = nil, nil, 0, false
+}
+
+// release gives back everything this took from the budget and forgets what it was.
+func (w *capture) release() {
+	w.budget.give(len(w.head) + len(w.tail))
+	w.head, w.tail, w.pos, w.full = nil, nil, 0, false
+}
+
+// close finishes off the spill file, if there is one, and says where it is.
+func (w *capture) close() (string, error) {
+	if w.file == nil {
+		return "", nil
+	}
+	return w.file.Name(), w.file.Close()
+}
+
+// tailBytes is what the tail's kept, oldest first.
+func (w *capture) tailBytes() []byte {
+	if !w.full {
+		return w.tail[:w.pos]
+	}
+	return append(append([]byte{}, w.tail[w.pos:]...), w.tail[:w.pos]...)
+}
+
+// raw is what was kept, as it came.  If it was spilled that's the last spillScan bytes of the
+// file, which is where the error that killed the job usually is.
+func (w *capture) raw() []byte {
+	if w.file == nil {
+		return append(append([]byte{}, w.head...), w.tailBytes()...)
+	}
+
+	f, err := os.Open(w.file.Name())
+	if err == nil {
+		defer f.Close()
+		var st os.FileInfo
+		if st, err = f.Stat(); err == nil {
+			_, err = f.Seek(max(0, st.Size()-spillScan), io.SeekStart)
+		}
+	}
+	var b []byte
+	if err == nil {
+		b, err = io.ReadAll(f)
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("reading spilled output back: %v", err))
+	}
+	return b
+}
+
+// dropped is how many bytes didn't make it.
+func (w *capture) dropped() int64 {
+	if w.file != nil {
+		return 0
+	}
+	kept := len(w.head) + w.pos
+	if w.full {
+		kept = len(w.head) + len(w.tail)
+	}
+	return w.written - int64(kept)
+}
+
+// render is a stream the way --output-mode wants it in the JSON: lines, the whole thing as one
+// string, base64, or nothing.  If the middle's gone the head and the tail are split into lines
+// separately, so a line cut in half doesn't get glued to some other line.  Anything that was
+// spilled is in its file and nowhere else.
+func (w *capture) render(mode string) []string {
+	if w.file != nil || mode == OutputNone || w.written == 0 {
+		return []string{}
+	}
+
+	head, tail := w.head, w.tailBytes()
+	switch mode {
+	case OutputRaw:
+		return []string{string(head) + string(tail)}
+	case OutputBase64:
+		return []string{base64.StdEncoding.EncodeToString(append(append([]byte{}, head...), tail...))}
+	}
+
+	if w.dropped() == 0 {
+		return splitLines(string(head) + string(tail))
+	}
+	return append(splitLines(string(head)), splitLines(string(tail))...)
+}
+
+// splitLines is output as lines, without the empty one strings.Split finds after the last newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// text says whether what was kept is UTF-8, which is all JSON can hold.  Where the middle was
+// dropped the cut can land halfway through a character, which doesn't make it binary.
+func (w *capture) text() bool {
+	head, tail := w.head, w.tailBytes()
+
+	if w.dropped() > 0 {
+		for n := 1; n < utf8.UTFMax && n <= len(head); n++ {
+			if utf8.RuneStart(head[len(head)-n]) {
+				if !utf8.FullRune(head[len(head)-n:]) {
+					head = head[:len(head)-n]
+				}
+				break
+			}
+		}
+		for n := 0; n < utf8.UTFMax-1 && len(tail) > 0 && !utf8.RuneStart(tail[0]); n++ {
+			tail = tail[1:]
+		}
+	}
+
+	return utf8.Valid(head) && utf8.Valid(tail)
+}
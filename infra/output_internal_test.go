@@ -0,0 +1,181 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_capture(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		max      int
+		budget   int
+		writes   []string
+		expected []string
+		dropped  int64
+	}{
+		{name: "no limit", writes: []string{"a\nb", "\nc\n"}, expected: []string{"a", "b", "c"}},
+		{name: "under the limit", max: 10, writes: []string{"a\nb\n"}, expected: []string{"a", "b"}},
+		{name: "exactly the limit", max: 4, writes: []string{"a\nb\n"}, expected: []string{"a", "b"}},
+		{name: "middle dropped", max: 4, writes: []string{"1\n2\n3\n4\n5\n"}, expected: []string{"1", "5"}, dropped: 6},
+		{name: "lots of little writes", max: 6, writes: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}, expected: []string{"abc", "ghi"}, dropped: 3},
+		{name: "line cut in half", max: 4, writes: []string{"hello\nworld\n"}, expected: []string{"he", "d"}, dropped: 8},
+		{name: "budget", budget: 3, writes: []string{"a\nb\nc\n"}, expected: []string{"a", "b"}, dropped: 3},
+		{name: "budget and limit", max: 4, budget: 3, writes: []string{"1\n2\n3\n4\n5\n"}, expected: []string{"1", ""}, dropped: 7},
+	}
+
+	for _, tc := range testCases {
+		var budget *outputBudget
+		if tc.budget > 0 {
+			budget = budgetFrom(withOutputBudget(context.Background(), Flags{MaxOutputTotal: tc.budget}))
+		}
+
+		w := newCapture(tc.max, budget)
+		for _, s := range tc.writes {
+			w.Write([]byte(s))
+		}
+
+		if diff := cmp.Diff(tc.expected, w.render(OutputLines)); diff != "" {
+			t.Errorf("%v: lines diff\n%s", tc.name, diff)
+		}
+		if got := w.dropped(); got != tc.dropped {
+			t.Errorf("%v: expected %v bytes dropped, got %v", tc.name, tc.dropped, got)
+		}
+	}
+}
+
+func Test_maxOutput(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Command{Substituted: "seq 100000; seq 3 >&2"}
+
+	executeSingleCommand(ctx, cancel, c, Flags{Shell: DefaultShell, MaxOutput: 14, JobTimeout: time.Minute})
+
+	if diff := cmp.Diff([]string{"1", "2", "3", "4", "100000"}, c.Stdout); diff != "" {
+		t.Errorf("stdout diff\n%s", diff)
+	}
+	if !c.StdoutTruncated || c.StderrTruncated {
+		t.Errorf("only stdout should be truncated: %v %v", c.StdoutTruncated, c.StderrTruncated)
+	}
+	if c.BytesDropped <= 0 {
+		t.Errorf("should have dropped something, got %v", c.BytesDropped)
+	}
+}
+
+func Test_spill(t *testing.T) {
+
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "results")
+	flags := Flags{Shell: DefaultShell, Spill: 4, ResultsDir: dir, JobTimeout: time.Minute, MaxOutputTotal: 100}
+	ctx := withSpillDir(withOutputBudget(context.Background(), flags), flags)
+
+	if got := spillDirFrom(ctx).where(); got != "" {
+		t.Errorf("nothing's been spilled yet, but where() is %q", got)
+	}
+
+	big := &Command{ID: 7, Substituted: "seq 5; echo hi >&2"}
+	jobCtx, cancel := context.WithCancel(ctx)
+	executeSingleCommand(jobCtx, cancel, big, flags)
+
+	small := &Command{ID: 8, Substituted: "echo 1"}
+	jobCtx, cancel = context.WithCancel(ctx)
+	executeSingleCommand(jobCtx, cancel, small, flags)
+
+	if big.StdoutFile != filepath.Join(dir, "7.stdout") || len(big.Stdout) != 0 {
+		t.Errorf("big stdout should be spilled: %q %q", big.StdoutFile, big.Stdout)
+	}
+	if b, err := os.ReadFile(big.StdoutFile); err != nil || string(b) != "1\n2\n3\n4\n5\n" {
+		t.Errorf("spilled stdout is wonky: %q %v", b, err)
+	}
+	if big.StderrFile != "" || !cmp.Equal(big.Stderr, []string{"hi"}) {
+		t.Errorf("stderr should still be in memory: %q %q", big.StderrFile, big.Stderr)
+	}
+	if small.StdoutFile != "" || !cmp.Equal(small.Stdout, []string{"1"}) {
+		t.Errorf("small stdout should still be in memory: %q %q", small.StdoutFile, small.Stdout)
+	}
+	if got := spillDirFrom(ctx).where(); got != dir {
+		t.Errorf("expected output in %q, got %q", dir, got)
+	}
+
+	// --retry-on can still see stderr once it's on disk
+	flags.RetryOn = []string{"stderr:oops"}
+	spilled := &Command{ID: 9, Substituted: "echo oops >&2; seq 5 >&2"}
+	jobCtx, cancel = context.WithCancel(ctx)
+	stderr, _ := executeSingleCommand(jobCtx, cancel, spilled, flags)
+	if spilled.StderrFile == "" || string(stderr) != "oops\n1\n2\n3\n4\n5\n" {
+		t.Errorf("stderr should be spilled and read back: %q %q", spilled.StderrFile, stderr)
+	}
+
+	// --max-output never drops anything that could have been spilled instead
+	capped := flags
+	capped.MaxOutput = 2
+	short := &Command{ID: 10, Substituted: "echo abc"}
+	jobCtx, cancel = context.WithCancel(ctx)
+	executeSingleCommand(jobCtx, cancel, short, capped)
+	if b, err := os.ReadFile(short.StdoutFile); err != nil || string(b) != "abc\n" || short.BytesDropped != 0 {
+		t.Errorf("truncated stdout should be spilled whole: %q %v, %v dropped", b, err, short.BytesDropped)
+	}
+
+	// what went to disk doesn't count against --max-output-total
+	if left := budgetFrom(ctx).left.Load(); left != 100-3-2 {
+		t.Errorf("expected %v left in the budget, got %v", 100-3-2, left)
+	}
+}
+
+func Test_outputMode(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		command  string
+		mode     string
+		expected []string
+		encoding string
+	}{
+		{command: `printf 'a\nb\n'`, mode: "", expected: []string{"a", "b"}},
+		{command: `printf 'a\n\nb'`, mode: OutputLines, expected: []string{"a", "", "b"}},
+		{command: `printf 'a\nb\n'`, mode: OutputRaw, expected: []string{"a\nb\n"}},
+		{command: `printf 'a\nb\n'`, mode: OutputBase64, expected: []string{"YQpiCg=="}, encoding: "base64"},
+		{command: `printf 'a\nb\n'`, mode: OutputNone, expected: []string{}},
+		{command: `true`, mode: OutputRaw, expected: []string{}},
+		{command: `printf 'caf\303\251\n'`, mode: OutputLines, expected: []string{"café"}},
+		{command: `printf '\377\376\n'`, mode: OutputLines, expected: []string{"//4K"}, encoding: "base64"},
+		{command: `printf '\377\376\n'`, mode: OutputRaw, expected: []string{"//4K"}, encoding: "base64"},
+		{command: `printf '\377\376\n'`, mode: OutputNone, expected: []string{}},
+	}
+
+	for _, tc := range testCases {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &Command{Substituted: tc.command}
+		executeSingleCommand(ctx, cancel, c, Flags{Shell: DefaultShell, OutputMode: tc.mode, JobTimeout: time.Minute})
+
+		if diff := cmp.Diff(tc.expected, c.Stdout); diff != "" {
+			t.Errorf("%q with %q: stdout diff\n%s", tc.command, tc.mode, diff)
+		}
+		if c.Encoding != tc.encoding {
+			t.Errorf("%q with %q: expected encoding %q, got %q", tc.command, tc.mode, tc.encoding, c.Encoding)
+		}
+	}
+
+	// a --max-output cut through the middle of a character doesn't make it binary
+	w := newCapture(6, nil)
+	w.Write([]byte("ééééé"))
+	if !w.text() {
+		t.Errorf("truncated UTF-8 should still be text: %q %q", w.head, w.tailBytes())
+	}
+
+	if err := checkOutputMode("json"); err == nil {
+		t.Error("expected an error with --output-mode json")
+	}
+}
@@ -0,0 +1,373 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBlockSize is how big --pipe chunks are if --block isn't given.
+const DefaultBlockSize = 1024 * 1024
+
+// ChunkInfo says which piece of a --pipe stream a job was fed.  End is exclusive, so a chunk is
+// bytes [start, end) of the input.
+type ChunkInfo struct {
+	Index int   `json:"index"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// DoPipe is Do for --pipe.  Instead of running the template once per target it cuts r up into
+// chunks of about flags.BlockSize bytes, breaking only at the end of a record, and feeds each
+// chunk to a job on stdin.  Chunks are read as jobs need them, so there are never more than
+// about flags.GoroutineLimit of them in memory however big the input is.
+func DoPipe(template string, r io.Reader, flags Flags) (Results, error) {
+	var res = Results{}
+
+	slog.Debug(fmt.Sprintf("calling DoPipe with %v %v", template, flags))
+
+	flagErrors = flags.FlagErrors
+	systemStartTime := time.Now()
+
+	if flags.BlockSize <= 0 {
+		flags.BlockSize = DefaultBlockSize
+	}
+	if flags.RecordEnd == "" {
+		flags.RecordEnd = "\n"
+	}
+	if flags.GoroutineLimit == 0 {
+		flags.GoroutineLimit = runtime.NumCPU()
+	}
+	if flags.RunID == "" {
+		flags.RunID = newRunID()
+	}
+
+	if _, err := parseRetryOn(flags.RetryOn); err != nil {
+		return res, err
+	}
+	if _, err := parseHalt(flags.Halt); err != nil {
+		return res, err
+	}
+	if flags.Reassemble != "" && flags.OutputMode == OutputNone {
+		return res, errors.New("can't reassemble output with --output-mode none")
+	}
+
+	newJob, err := newChunkJob(template, flags)
+	if err != nil {
+		return res, fmt.Errorf("error building command: %w", err)
+	}
+	// chunks don't have targets, so find out now rather than halfway through the input if the
+	// template wants one
+	if _, err := newJob(0); err != nil {
+		return res, fmt.Errorf("error building command: %w", err)
+	}
+
+	ctx, cancelCtx := newLoopContext(flags)
+	defer cancelCtx()
+
+	interrupted, stopCatching := catchInterrupts(cancelCtx, flags)
+	defer stopCatching()
+
+	source, readErr := chunkSource(ctx, r, newJob, flags)
+
+	completedCommands, pbarOffset, halted := runLoop(ctx, cancelCtx, source, -1, flags)
+
+	res = makeResults(template, completedCommands, systemStartTime, pbarOffset, flags)
+	res.Info.TotalJobs = len(completedCommands)
+	res.Info.Halted = halted
+	res.Info.Interrupted = interrupted()
+	res.Info.ResultsDir = spillDirFrom(ctx).where()
+
+	// the loop's done with the input whether or not there's more of it, e.g. after a --halt or a
+	// Ctrl-C, and the read that's under way might never finish.  A read error that stopped the
+	// input is already waiting by the time the loop's seen the end of it.
+	cancelCtx()
+	select {
+	case err := <-readErr:
+		if err != nil {
+			slog.Error(fmt.Sprintf("error reading input: %v", err))
+		}
+	default:
+	}
+
+	if flags.Reassemble != "" {
+		if err := reassemble(flags.Reassemble, completedCommands, flags.OutputMode); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// newChunkJob renders everything about a job that doesn't depend on its chunk.
+func newChunkJob(template string, flags Flags) (func(id JobID) (*Command, error), error) {
+	render, err := newRenderer(template, flags)
+	if err != nil {
+		return nil, err
+	}
+	renderEnv, err := newEnvRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+	renderWorkdir, err := newWorkdirRenderer(flags)
+	if err != nil {
+		return nil, err
+	}
+	env := environ()
+
+	return func(id JobID) (*Command, error) {
+		var err error
+		d := jobData{Fields: []string{}, ID: id, Seq: int(id) + 1, Env: env}
+
+		c := &Command{ID: id, Status: TBD, Arg: []string{}}
+		if c.Substituted, err = render(d); err != nil {
+			return nil, err
+		}
+		if renderEnv != nil {
+			if c.EnvVars, err = renderEnv(d); err != nil {
+				return nil, err
+			}
+		}
+		if renderWorkdir != nil {
+			if c.Dir, err = renderWorkdir(d); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	}, nil
+}
+
+// chunkSource reads chunks from r and hands each one to a new job.  Whatever went wrong reading
+// r shows up on the error channel once the command channel's closed.
+func chunkSource(ctx context.Context, r io.Reader, newJob func(JobID) (*Command, error), flags Flags) (<-chan *Command, <-chan error) {
+	source := make(chan *Command)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(readErr)
+		defer close(source)
+
+		ch := newChunker(r, flags.BlockSize, []byte(flags.RecordEnd))
+		var id JobID
+
+		for {
+			data, start, err := ch.next()
+
+			if len(data) > 0 {
+				c, jobErr := newJob(id)
+				if jobErr != nil {
+					readErr <- jobErr
+					return
+				}
+				c.StdinData = data
+				c.Chunk = &ChunkInfo{Index: int(id), Start: start, End: start + int64(len(data))}
+				id += 1
+
+				select {
+				case source <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	return source, readErr
+}
+
+// chunker cuts a stream into blocks of at least size bytes which end in recEnd.  A record longer
+// than a block makes a block as long as the record.  The last block is whatever's left, recEnd or not.
+type chunker struct {
+	r      io.Reader
+	size   int
+	recEnd []byte
+	buf    []byte // read but not handed out yet
+	offset int64  // where buf starts in the stream
+	eof    bool
+}
+
+func newChunker(r io.Reader, size int, recEnd []byte) *chunker {
+	return &chunker{r: r, size: size, recEnd: recEnd}
+}
+
+// fill reads until buf has at least n bytes in it or the input runs out.
+func (ch *chunker) fill(n int) error {
+	for len(ch.buf) < n && !ch.eof {
+		tmp := make([]byte, n-len(ch.buf))
+		got, err := io.ReadFull(ch.r, tmp)
+		ch.buf = append(ch.buf, tmp[:got]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			ch.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next chunk and where it starts in the stream.  It returns io.EOF along with
+// the last chunk, or with nothing once there's nothing left.
+func (ch *chunker) next() ([]byte, int64, error) {
+	start := ch.offset
+
+	if err := ch.fill(ch.size); err != nil {
+		return nil, start, err
+	}
+
+	cut := -1
+	if len(ch.recEnd) > 0 && len(ch.buf) >= ch.size {
+		// the last record end in the block if there is one, otherwise the first one after it
+		if i := bytes.LastIndex(ch.buf, ch.recEnd); i >= 0 {
+			cut = i + len(ch.recEnd)
+		}
+		for cut < 0 && !ch.eof {
+			searched := max(0, len(ch.buf)-len(ch.recEnd)+1)
+			if err := ch.fill(len(ch.buf) + ch.size); err != nil {
+				return nil, start, err
+			}
+			if i := bytes.Index(ch.buf[searched:], ch.recEnd); i >= 0 {
+				cut = searched + i + len(ch.recEnd)
+			}
+		}
+	} else if len(ch.buf) >= ch.size {
+		cut = ch.size
+	}
+
+	if cut < 0 { // the rest of the input
+		data := ch.buf
+		ch.buf = nil
+		ch.offset += int64(len(data))
+		if ch.eof {
+			return data, start, io.EOF
+		}
+		return data, start, nil
+	}
+
+	data := ch.buf[:cut]
+	rest := make([]byte, len(ch.buf)-cut)
+	copy(rest, ch.buf[cut:])
+	ch.buf = rest
+	ch.offset += int64(len(data))
+
+	if ch.eof && len(ch.buf) == 0 {
+		return data, start, io.EOF
+	}
+	return data, start, nil
+}
+
+// reassemble writes the stdout of every chunk's job to path in chunk order, so the output lines
+// up with the input however the jobs were scheduled.
+func reassemble(path string, cl CommandList, mode string) error {
+	var chunks CommandList
+	for _, c := range cl {
+		if c.Chunk != nil {
+			chunks = append(chunks, c)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Chunk.Index < chunks[j].Chunk.Index
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("reassembling output: %w", err)
+	}
+	defer f.Close()
+
+	next := 0
+	for _, c := range chunks {
+		if c.Chunk.Index != next {
+			slog.Error(fmt.Sprintf("reassembling output: chunks %v to %v are missing", next, c.Chunk.Index-1))
+		}
+		next = c.Chunk.Index + 1
+
+		if c.Status != Finished {
+			slog.Error(fmt.Sprintf("reassembling output: chunk %v %v", c.Chunk.Index, c.Status))
+		}
+		if err := writeStdout(f, c, mode); err != nil {
+			return fmt.Errorf("reassembling output: %w", err)
+		}
+	}
+
+	return f.Close()
+}
+
+// writeStdout copies a job's stdout to w, from its --spill file if it has one.  Lines don't say
+// whether the last one had a newline, so they all get one.
+func writeStdout(w io.Writer, c *Command, mode string) error {
+	switch {
+	case c.StdoutFile != "":
+		f, err := os.Open(c.StdoutFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+
+	case c.Encoding == "base64":
+		b, err := base64.StdEncoding.DecodeString(strings.Join(c.Stdout, ""))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+
+	case mode == OutputRaw:
+		_, err := io.WriteString(w, strings.Join(c.Stdout, ""))
+		return err
+	}
+
+	for _, line := range c.Stdout {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSize parses sizes like 512, 64K, 10M or 1G.  Units are powers of 1024.
+func parseSize(s string) (int, error) {
+	mult := 1
+	num := strings.TrimSpace(s)
+
+	if num != "" {
+		switch strings.ToUpper(num[len(num)-1:]) {
+		case "K":
+			mult = 1024
+		case "M":
+			mult = 1024 * 1024
+		case "G":
+			mult = 1024 * 1024 * 1024
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid size " + strconv.Quote(s))
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,171 @@
+package infra
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_chunker(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		input    string
+		size     int
+		recEnd   string
+		expected []string
+	}{
+		{name: "empty", input: "", size: 4, recEnd: "\n", expected: nil},
+		{name: "one short record", input: "a\n", size: 4, recEnd: "\n", expected: []string{"a\n"}},
+		{name: "break on records", input: "aa\nbb\ncc\ndd\n", size: 5, recEnd: "\n", expected: []string{"aa\n", "bb\n", "cc\n", "dd\n"}},
+		{name: "several records per block", input: "a\nb\nc\nd\ne\n", size: 4, recEnd: "\n", expected: []string{"a\nb\n", "c\nd\n", "e\n"}},
+		{name: "long record", input: "a\nbbbbbbbbbb\nc\n", size: 4, recEnd: "\n", expected: []string{"a\n", "bbbbbbbbbb\n", "c\n"}},
+		{name: "no trailing record end", input: "a\nb\nccc", size: 4, recEnd: "\n", expected: []string{"a\nb\n", "ccc"}},
+		{name: "no record end at all", input: "abcdefghij", size: 4, recEnd: "\n", expected: []string{"abcdefghij"}},
+		{name: "multibyte record end", input: "a--b--c--", size: 3, recEnd: "--", expected: []string{"a--", "b--", "c--"}},
+		{name: "record end across reads", input: "aaaa--b--", size: 5, recEnd: "--", expected: []string{"aaaa--", "b--"}},
+		{name: "long record stops at its end", input: "aaaaaaa\nb\nc\n", size: 4, recEnd: "\n", expected: []string{"aaaaaaa\n", "b\nc\n"}},
+		{name: "fixed size", input: "abcdefghij", size: 4, recEnd: "", expected: []string{"abcd", "efgh", "ij"}},
+	}
+
+	for _, tc := range testCases {
+		// one byte per read makes sure nothing relies on getting a whole block at once
+		ch := newChunker(iotest.OneByteReader(strings.NewReader(tc.input)), tc.size, []byte(tc.recEnd))
+
+		var got []string
+		var offset int64
+		for {
+			data, start, err := ch.next()
+			if len(data) > 0 {
+				if start != offset {
+					t.Errorf("%v: chunk %v starts at %v, expected %v", tc.name, len(got), start, offset)
+				}
+				offset += int64(len(data))
+				got = append(got, string(data))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+		}
+
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%v: chunk diff\n%s", tc.name, diff)
+		}
+	}
+}
+
+func Test_parseSize(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		input      string
+		expected   int
+		expectPass bool
+	}{
+		{input: "512", expected: 512, expectPass: true},
+		{input: "64K", expected: 64 * 1024, expectPass: true},
+		{input: "10m", expected: 10 * 1024 * 1024, expectPass: true},
+		{input: "1G", expected: 1024 * 1024 * 1024, expectPass: true},
+		{input: "0", expectPass: false},
+		{input: "-1K", expectPass: false},
+		{input: "M", expectPass: false},
+		{input: "ten", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseSize(tc.input)
+
+		if tc.expectPass && err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.input)
+		}
+		if !tc.expectPass && err == nil {
+			t.Errorf("no error when there should be one with %q", tc.input)
+		}
+		if got != tc.expected {
+			t.Errorf("expected %v for %q, got %v", tc.expected, tc.input, got)
+		}
+	}
+}
+
+func Test_DoPipe(t *testing.T) {
+
+	t.Parallel()
+
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		input.WriteString("line\n")
+	}
+	out := filepath.Join(t.TempDir(), "out.txt")
+
+	flags := Flags{Token: DefaultToken, GoroutineLimit: 4, JobTimeout: time.Minute, BlockSize: 512, Reassemble: out}
+	res, err := DoPipe("cat", strings.NewReader(input.String()), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 512 bytes is 102 and a bit lines, so ten chunks
+	if res.Info.TotalJobs != 10 {
+		t.Errorf("expected 10 chunks, got %v", res.Info.TotalJobs)
+	}
+	for _, c := range res.Commands {
+		if c.Status != Finished {
+			t.Errorf("chunk %v: expected status %v but got %v", c.Chunk.Index, Finished, c.Status)
+		}
+		if c.StdinData != nil {
+			t.Errorf("chunk %v: stdin data should have been let go", c.Chunk.Index)
+		}
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != input.String() {
+		t.Errorf("reassembled output doesn't match the input")
+	}
+
+	if _, err := DoPipe("cat {{1}}", strings.NewReader(input.String()), flags); err == nil {
+		t.Error("expected an error using {{1}} with --pipe")
+	}
+}
+
+func Test_DoPipe_halt(t *testing.T) {
+
+	t.Parallel()
+
+	// input that never ends, like tail -f
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("a\n"))
+
+	flags := Flags{Token: DefaultToken, GoroutineLimit: 1, JobTimeout: time.Minute, BlockSize: 1, Halt: "now,fail=1", LogLevel: "q"}
+	finished := make(chan Results)
+	go func() {
+		res, err := DoPipe("false", r, flags)
+		if err != nil {
+			t.Error(err)
+		}
+		finished <- res
+	}()
+
+	select {
+	case res := <-finished:
+		if res.Info.Halted != flags.Halt {
+			t.Errorf("expected halted %q, got %q", flags.Halt, res.Info.Halted)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still waiting for more input after halting")
+	}
+}
@@ -0,0 +1,185 @@
+package infra
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultToken is the default value of --token.  When the token is left alone the
+// template is treated as having positional placeholders {{1}} .. {{N}}, one per column
+// of the target.  A custom token is a plain string swapped for the whole target.
+const DefaultToken = "{{1}}"
+
+// DefaultShell is what --shell runs commands with if --shell-cmd doesn't say otherwise.
+const DefaultShell = "/bin/sh -c"
+
+// jobData is everything a template gets to know about a job when it's built.  Field
+// names are what --template-engine go templates see, e.g. {{ .Target }} or {{ index .Fields 1 }}.
+type jobData struct {
+	Target string
+	Fields []string
+	Vars   map[string]string
+	ID     JobID
+	Seq    int // ID + 1, parallel's {#}
+	Env    map[string]string
+}
+
+// checkTemplateNotTarget catches a command that's ended up as a target, which is what happens
+// when something that looks like an option's value is really the command, e.g.
+// concur --shell "bash -c" "echo {{1}}" a.  The "command" has no placeholders and the first
+// target is full of them.
+func checkTemplateNotTarget(command string, targets []string, flags Flags) error {
+	if len(targets) == 0 || strings.Contains(command, "{{") || (flags.Token != "" && strings.Contains(command, flags.Token)) {
+		return nil
+	}
+	if strings.Contains(targets[0], "{{") || (flags.Token != "" && strings.Contains(targets[0], flags.Token)) {
+		return fmt.Errorf("command %q has no placeholders but target %q does, was the command taken for a target?", command, targets[0])
+	}
+	return nil
+}
+
+// renderFunc turns a template into a command for a single job.
+type renderFunc func(d jobData) (string, error)
+
+// newRenderer picks a template engine based on flags for rendering a command.  Values from
+// targets are always shell quoted, shell or no shell, since the command gets split up into words
+// with shell rules either way and a file called "my file.txt" should stay one word.
+func newRenderer(command string, flags Flags) (renderFunc, error) {
+	return pickRenderer(command, flags, true)
+}
+
+// newTextRenderer is newRenderer for things which aren't command lines, like --env values or
+// --workdir, so nothing gets quoted.
+func newTextRenderer(tmpl string, flags Flags) (renderFunc, error) {
+	return pickRenderer(tmpl, flags, false)
+}
+
+func pickRenderer(command string, flags Flags, quote bool) (renderFunc, error) {
+	switch flags.TemplateEngine {
+	case "", "simple":
+		return newSimpleRenderer(command, flags.Token, quote), nil
+	case "go":
+		return newGoRenderer(command, quote)
+	default:
+		return nil, fmt.Errorf("unknown template engine %q", flags.TemplateEngine)
+	}
+}
+
+// newSimpleRenderer does {{N}} column and {{#}} substitution plus the optional custom token.  With
+// quote set, values from targets are shell quoted so they stay one word and can't turn into extra
+// commands.
+func newSimpleRenderer(command string, token string, quote bool) renderFunc {
+	return func(d jobData) (string, error) {
+		substituted, err := substitutePlaceholders(command, d, quote)
+		if err != nil {
+			return "", err
+		}
+		if token != "" && token != DefaultToken {
+			t := d.Target
+			if quote {
+				t = shellQuote(t)
+			}
+			substituted = strings.ReplaceAll(substituted, token, t)
+		}
+		return substituted, nil
+	}
+}
+
+// SlotToken is replaced with the worker slot number (1 .. concurrency limit) when a job starts.  It can't
+// be filled in up front like everything else because nobody knows which slot a job gets until it runs.
+const SlotToken = "{{%}}"
+
+// TmpdirToken is replaced with the job's own scratch directory when it starts, which is also in
+// its environment as CONCUR_TMPDIR.
+const TmpdirToken = "{{tmpdir}}"
+
+// matches {{N}} or {{name}} with an optional GNU parallel style modifier and an optional |raw, or {{#}}
+var placeholderRE = regexp.MustCompile(`\{\{(?:([0-9]+|[A-Za-z_][A-Za-z0-9_]*)(/\.|//|/|\.)?(\|raw)?|(#))\}\}`)
+
+// splitTarget breaks a target up into columns.  An empty delimiter means split on any run of
+// whitespace or commas, so "r1 10.0.0.1", "r1,10.0.0.1" and "r1\t10.0.0.1" all give two columns.
+func splitTarget(target string, delimiter string) []string {
+	if delimiter == "" {
+		return strings.FieldsFunc(target, func(r rune) bool {
+			return unicode.IsSpace(r) || r == ','
+		})
+	}
+
+	return strings.Split(target, delimiter)
+}
+
+// applyModifier does what parallel's {.} {/} {//} and {/.} do.
+func applyModifier(s string, modifier string) string {
+	switch modifier {
+	case ".": // strip extension
+		return strings.TrimSuffix(s, filepath.Ext(s))
+	case "/": // basename
+		return filepath.Base(s)
+	case "//": // dirname
+		return filepath.Dir(s)
+	case "/.": // basename, no extension
+		b := filepath.Base(s)
+		return strings.TrimSuffix(b, filepath.Ext(b))
+	default:
+		return s
+	}
+}
+
+// substitutePlaceholders replaces every {{N}} in command with column N of the target and every
+// {{name}} with the named value (after any modifier), and {{#}} with the 1-based job sequence number.
+// With quote set values are shell quoted, unless they're asked for with |raw.
+func substitutePlaceholders(command string, d jobData, quote bool) (string, error) {
+	var err error
+
+	ret := placeholderRE.ReplaceAllStringFunc(command, func(m string) string {
+		sub := placeholderRE.FindStringSubmatch(m)
+		if sub[4] == "#" {
+			return strconv.Itoa(d.Seq)
+		}
+
+		var v string
+		if n, convErr := strconv.Atoi(sub[1]); convErr == nil {
+			if n < 1 || n > len(d.Fields) {
+				if err == nil {
+					err = fmt.Errorf("template references %s but target only has %d column(s)", m, len(d.Fields))
+				}
+				return m
+			}
+			v = d.Fields[n-1]
+		} else {
+			var ok bool
+			if v, ok = d.Vars[sub[1]]; !ok {
+				if m == TmpdirToken {
+					return m // filled in when the job starts
+				}
+				if err == nil {
+					err = fmt.Errorf("template references %s but there's no list or column called %q", m, sub[1])
+				}
+				return m
+			}
+		}
+
+		v = applyModifier(v, sub[2])
+		if quote && sub[3] == "" {
+			v = shellQuote(v)
+		}
+		return v
+	})
+
+	return ret, err
+}
+
+// anything made only of these is left alone by shellQuote
+var shellSafeRE = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote makes s safe to paste into a POSIX shell command line as a single word.
+func shellQuote(s string) string {
+	if shellSafeRE.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package infra
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// there are no process groups or signals to speak of here, so jobs get killed the usual way and
+// --kill-signal is ignored.
+
+func setupKill(cmd *exec.Cmd, flags Flags) (waitGroup func()) {
+	cmd.WaitDelay = flags.KillGrace + time.Second
+	return func() {}
+}
+
+func parseSignal(s string) (os.Signal, error) {
+	return os.Kill, nil
+}
+
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
@@ -0,0 +1,124 @@
+//go:build unix
+
+package infra
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signals by name for --kill-signal and for saying what ended a job
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGABRT": syscall.SIGABRT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parseSignal understands TERM, SIGTERM and 15.  Empty means SIGTERM.
+func parseSignal(s string) (syscall.Signal, error) {
+	if s == "" {
+		return syscall.SIGTERM, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return name
+		}
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// setupKill puts a job in a process group of its own so that when its context is done
+// everything it started can be signalled, not just the process concur started.  The group gets
+// --kill-signal first, then SIGKILL if it's still around after --kill-grace.  The function it
+// returns is for after the job's been waited for.  Anything the job left running in its group
+// gets the same treatment then, and it hangs on until the group's gone so nothing's left
+// running when concur exits.
+func setupKill(cmd *exec.Cmd, flags Flags) (waitGroup func()) {
+	sig, _ := parseSignal(flags.KillSignal) // already checked by PopulateFlags
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var deadline time.Time // when the group gets SIGKILL, zero if it was never signalled
+	var killTimer *time.Timer
+	killGroup := func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+
+	cmd.Cancel = func() error {
+		deadline = time.Now().Add(flags.KillGrace)
+		err := syscall.Kill(-cmd.Process.Pid, sig)
+		if sig != syscall.SIGKILL {
+			killTimer = time.AfterFunc(flags.KillGrace, killGroup)
+		}
+		if err == syscall.ESRCH {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+
+	// don't hang around forever for output from something that got away from the group
+	cmd.WaitDelay = flags.KillGrace + time.Second
+
+	return func() {
+		if cmd.Process == nil {
+			return // never started
+		}
+		if deadline.IsZero() {
+			// it exited by itself, but maybe not everything it started did
+			if syscall.Kill(-cmd.Process.Pid, sig) == syscall.ESRCH {
+				return
+			}
+			deadline = time.Now().Add(flags.KillGrace)
+		}
+		// from here on it's up to us, and the timer mustn't go off once the group's gone and its
+		// pgid could belong to something else
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+		for time.Now().Before(deadline) {
+			if syscall.Kill(-cmd.Process.Pid, 0) == syscall.ESRCH {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		killGroup()
+	}
+}
+
+// exitSignal is the signal that ended a job, if one did.
+func exitSignal(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return signalName(ws.Signal())
+	}
+	return ""
+}
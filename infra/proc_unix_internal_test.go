@@ -0,0 +1,135 @@
+//go:build unix
+
+package infra
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_parseSignal(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		input      string
+		expected   syscall.Signal
+		expectPass bool
+	}{
+		{input: "", expected: syscall.SIGTERM, expectPass: true},
+		{input: "TERM", expected: syscall.SIGTERM, expectPass: true},
+		{input: "sigint", expected: syscall.SIGINT, expectPass: true},
+		{input: "SIGKILL", expected: syscall.SIGKILL, expectPass: true},
+		{input: "1", expected: syscall.SIGHUP, expectPass: true},
+		{input: "BOGUS", expectPass: false},
+		{input: "-3", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseSignal(tc.input)
+
+		if tc.expectPass && err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.input)
+		}
+		if !tc.expectPass && err == nil {
+			t.Errorf("no error when there should be one with %q", tc.input)
+		}
+		if got != tc.expected {
+			t.Errorf("expected %v for %q, got %v", tc.expected, tc.input, got)
+		}
+	}
+}
+
+func Test_killGroup(t *testing.T) {
+
+	t.Parallel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	// the grandchild ignores SIGTERM, so it takes the SIGKILL after the grace period to get rid of it
+	c := &Command{Substituted: "(trap '' TERM; sleep 30) & echo $! > " + shellQuote(pidFile) + "; sleep 30"}
+	flags := Flags{Shell: DefaultShell, KillGrace: 300 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	executeSingleCommand(ctx, cancel, c, flags)
+
+	if c.Status != TimedOut {
+		t.Errorf("expected status %v but got %v", TimedOut, c.Status)
+	}
+	if c.Signal != "SIGTERM" {
+		t.Errorf("expected the job to end with SIGTERM, got %q", c.Signal)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SIGKILL has been sent, give it a moment to go away
+	for i := 0; alive(pid); i++ {
+		if i == 20 {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild %v is still running after the job was killed", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func Test_killGroup_leftovers(t *testing.T) {
+
+	t.Parallel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	// the job itself is fine, but what it leaves behind is holding on to its stdout
+	c := &Command{Substituted: "sleep 30 & echo $! > " + shellQuote(pidFile) + "; echo hi"}
+	flags := Flags{Shell: DefaultShell, KillGrace: 300 * time.Millisecond, JobTimeout: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	executeSingleCommand(ctx, cancel, c, flags)
+
+	if c.Status != Finished || c.ReturnCode != 0 || c.Error != "" {
+		t.Errorf("expected Finished with 0, got %v with %v %q", c.Status, c.ReturnCode, c.Error)
+	}
+	if len(c.Stdout) != 1 || c.Stdout[0] != "hi" {
+		t.Errorf("expected stdout hi, got %q", c.Stdout)
+	}
+	if c.RunTime > 10*time.Second {
+		t.Errorf("should be done once the leftovers are killed, took %v", c.RunTime)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; alive(pid); i++ {
+		if i == 20 {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("leftover %v is still running after the job finished", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// alive counts zombies as dead, since whether they're reaped is up to whoever init is.
+func alive(pid int) bool {
+	if syscall.Kill(pid, 0) == syscall.ESRCH {
+		return false
+	}
+	out, _ := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
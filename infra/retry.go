@@ -0,0 +1,216 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetryDelay is how long to wait before the first retry if --retry-delay isn't given.
+// Every retry after that waits twice as long as the one before.
+const DefaultRetryDelay = time.Second
+
+// never wait longer than this between attempts, however many there have been
+const maxRetryDelay = 5 * time.Minute
+
+// how much of each stream an attempt keeps, the end being where the error usually is
+const attemptLines = 10
+
+// Attempt is one go at running a job when --retries is set.
+type Attempt struct {
+	Attempt          int       `json:"attempt"`
+	Status           JobStatus `json:"jobstatus"`
+	StartTime        time.Time `json:"starttime"`
+	EndTime          time.Time `json:"endtime"`
+	RunTimePrintable string    `json:"runtime"`
+	ReturnCode       int       `json:"returncode"`
+	Error            string    `json:"error,omitempty"`
+	Stdout           []string  `json:"stdout"` // the last few lines
+	Stderr           []string  `json:"stderr"`
+	Encoding         string    `json:"encoding,omitempty"`
+	TmpDir           string    `json:"tmpdir,omitempty"` // kept for a failed attempt of a job that failed
+}
+
+// what a job with retries ended up as
+const (
+	VerdictSucceeded = "succeeded" // worked, maybe not the first time
+	VerdictFailed    = "failed"    // failed in a way --retry-on says isn't worth retrying
+	VerdictGaveUp    = "gave up"   // still failing when the retries ran out
+	VerdictCancelled = "cancelled" // the run ended before the retries did
+)
+
+// retryRules is --retry-on.  Each rule is an exit code, a status like TimedOut, or stderr:regex
+// to look for in the job's stderr.  No rules at all means any failure is worth retrying.
+type retryRules struct {
+	codes    map[int]bool
+	statuses map[JobStatus]bool
+	stderr   []*regexp.Regexp
+}
+
+func parseRetryOn(specs []string) (retryRules, error) {
+	rules := retryRules{codes: map[int]bool{}, statuses: map[JobStatus]bool{}}
+
+Specs:
+	for _, spec := range specs {
+		if re, ok := strings.CutPrefix(spec, "stderr:"); ok {
+			compiled, err := regexp.Compile(re)
+			if err != nil {
+				return rules, fmt.Errorf("retry-on %q: %w", spec, err)
+			}
+			rules.stderr = append(rules.stderr, compiled)
+			continue
+		}
+
+		if code, err := strconv.Atoi(spec); err == nil {
+			rules.codes[code] = true
+			continue
+		}
+
+		for _, s := range []JobStatus{Errored, TimedOut} {
+			if strings.EqualFold(spec, s.String()) {
+				rules.statuses[s] = true
+				continue Specs
+			}
+		}
+
+		return rules, fmt.Errorf("invalid retry-on %q, want an exit code, Errored, TimedOut or stderr:regex", spec)
+	}
+
+	return rules, nil
+}
+
+// watchesStderr says whether --retry-on has any stderr: rules, in which case stderr has to be
+// kept even when --output-mode doesn't want it.
+func watchesStderr(flags Flags) bool {
+	for _, spec := range flags.RetryOn {
+		if strings.HasPrefix(spec, "stderr:") {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable says whether a failed job is worth another go.  stderr is what the job actually
+// wrote, not what --output-mode made of it.
+func (r retryRules) retryable(c *Command, stderr []byte) bool {
+	if len(r.codes) == 0 && len(r.statuses) == 0 && len(r.stderr) == 0 {
+		return true
+	}
+
+	if r.statuses[c.Status] {
+		return true
+	}
+	if c.Status != TimedOut && r.codes[c.ReturnCode] {
+		return true
+	}
+
+	for _, re := range r.stderr {
+		if re.Match(stderr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDelay is how long to wait before the next attempt: delay doubled for every retry so far,
+// then knocked down by up to half at random so a lot of jobs failing at once don't all come back at once.
+func retryDelay(delay time.Duration, retry int) time.Duration {
+	d := delay
+	for i := 1; i < retry && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxRetryDelay)
+
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// runJob runs a job once, or as many times as --retries and --retry-on allow, each attempt
+// getting its own job timeout.  The job ends up looking like its last attempt.
+func runJob(loopCtx context.Context, c *Command, rules retryRules, flags Flags) {
+	c.JobTimeout = flags.JobTimeout
+
+	if flags.Retries == 0 {
+		// TODO: what if flags.JobTimeout is zero?  need magic here?
+		//   duration is int64 so just set it to that? 290 years.
+		jobCtx, jobCancel := context.WithTimeout(loopCtx, flags.JobTimeout)
+		executeSingleCommand(jobCtx, jobCancel, c, flags)
+		return
+	}
+
+	// every attempt starts from the same command, with its own tmpdir
+	substituted, dir, env := c.Substituted, c.Dir, maps.Clone(c.EnvVars)
+	var firstStart time.Time
+
+	for attempt := 1; ; attempt++ {
+		c.Substituted, c.Dir, c.EnvVars = substituted, dir, maps.Clone(env)
+		c.Error, c.TmpDir = "", ""
+		c.StdoutTruncated, c.StderrTruncated, c.BytesDropped = false, false, 0
+		c.StdoutFile, c.StderrFile, c.Encoding = "", "", ""
+
+		jobCtx, jobCancel := context.WithTimeout(loopCtx, flags.JobTimeout)
+		stderr, release := executeSingleCommand(jobCtx, jobCancel, c, flags)
+		if attempt == 1 {
+			firstStart = c.StartTime
+		}
+		c.Attempts = append(c.Attempts, Attempt{
+			Attempt:          attempt,
+			Status:           c.Status,
+			StartTime:        c.StartTime,
+			EndTime:          c.EndTime,
+			RunTimePrintable: c.RunTimePrintable,
+			ReturnCode:       c.ReturnCode,
+			Error:            c.Error,
+			Stdout:           lastLines(c.Stdout, attemptLines),
+			Stderr:           lastLines(c.Stderr, attemptLines),
+			Encoding:         c.Encoding,
+			TmpDir:           c.TmpDir,
+		})
+		c.StartTime = firstStart
+
+		switch {
+		case c.Status == Finished && c.ReturnCode == 0:
+			c.Verdict = VerdictSucceeded
+			if !flags.KeepTmp {
+				// the job didn't fail in the end, so there's nothing to go and look at
+				for i := range c.Attempts {
+					os.RemoveAll(c.Attempts[i].TmpDir)
+					c.Attempts[i].TmpDir = ""
+				}
+			}
+			return
+		case loopCtx.Err() != nil:
+			c.Verdict = VerdictCancelled
+			return
+		case !rules.retryable(c, stderr):
+			c.Verdict = VerdictFailed
+			return
+		case attempt > flags.Retries:
+			c.Verdict = VerdictGaveUp
+			return
+		}
+		// all that's kept of this attempt is its last few lines, the next one gets its budget
+		release()
+
+		select {
+		case <-time.After(retryDelay(flags.RetryDelay, attempt)):
+		case <-loopCtx.Done():
+			c.Verdict = VerdictCancelled
+			return
+		}
+	}
+}
+
+// lastLines is the last n lines of output.
+func lastLines(lines []string, n int) []string {
+	return append([]string{}, lines[max(0, len(lines)-n):]...)
+}
@@ -0,0 +1,156 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_retryRules(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		specs      []string
+		c          Command
+		stderr     string
+		expected   bool
+		expectPass bool
+	}{
+		{specs: nil, c: Command{Status: Errored, ReturnCode: 1}, expected: true, expectPass: true},
+		{specs: []string{"255"}, c: Command{Status: Errored, ReturnCode: 255}, expected: true, expectPass: true},
+		{specs: []string{"255"}, c: Command{Status: Errored, ReturnCode: 1}, expected: false, expectPass: true},
+		{specs: []string{"timedout"}, c: Command{Status: TimedOut, ReturnCode: -1}, expected: true, expectPass: true},
+		{specs: []string{"-1"}, c: Command{Status: TimedOut, ReturnCode: -1}, expected: false, expectPass: true},
+		{specs: []string{"stderr:Connection (reset|refused)"}, c: Command{Status: Errored, ReturnCode: 255}, stderr: "ssh: connect to host r1 port 22: Connection refused\n", expected: true, expectPass: true},
+		{specs: []string{"stderr:Connection reset"}, c: Command{Status: Errored, ReturnCode: 1}, stderr: "Permission denied\n", expected: false, expectPass: true},
+		{specs: []string{"Finished"}, expectPass: false},
+		{specs: []string{"stderr:("}, expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		rules, err := parseRetryOn(tc.specs)
+
+		if !tc.expectPass {
+			if err == nil {
+				t.Errorf("no error when there should be one with %q", tc.specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.specs)
+			continue
+		}
+
+		if got := rules.retryable(&tc.c, []byte(tc.stderr)); got != tc.expected {
+			t.Errorf("%q: expected retryable %v for %v/%v, got %v", tc.specs, tc.expected, tc.c.Status, tc.c.ReturnCode, got)
+		}
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+
+	t.Parallel()
+
+	for retry, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 30: maxRetryDelay} {
+		for i := 0; i < 20; i++ {
+			if d := retryDelay(time.Second, retry); d < base/2 || d > base {
+				t.Errorf("retry %v: delay %v should be between %v and %v", retry, d, base/2, base)
+			}
+		}
+	}
+
+	if d := retryDelay(0, 3); d != 0 {
+		t.Errorf("no delay should stay no delay, got %v", d)
+	}
+}
+
+func Test_runJob(t *testing.T) {
+
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	testCases := []struct {
+		name     string
+		flags    Flags
+		attempts []int // return code of each attempt
+		verdict  string
+	}{
+		{name: "no retries", flags: Flags{}, attempts: nil, verdict: ""},
+		{name: "works eventually", flags: Flags{Retries: 5}, attempts: []int{255, 255, 0}, verdict: VerdictSucceeded},
+		{name: "runs out", flags: Flags{Retries: 1}, attempts: []int{255, 255}, verdict: VerdictGaveUp},
+		{name: "not worth retrying", flags: Flags{Retries: 5, RetryOn: []string{"stderr:timeout"}}, attempts: []int{255}, verdict: VerdictFailed},
+		{name: "stderr in base64", flags: Flags{Retries: 5, RetryOn: []string{"stderr:^flaky"}, OutputMode: OutputBase64}, attempts: []int{255, 255, 0}, verdict: VerdictSucceeded},
+		{name: "stderr not wanted", flags: Flags{Retries: 5, RetryOn: []string{"stderr:^flaky"}, OutputMode: OutputNone}, attempts: []int{255, 255, 0}, verdict: VerdictSucceeded},
+	}
+
+	for i, tc := range testCases {
+		// fails twice, then works
+		counter := shellQuote(filepath.Join(dir, tc.name))
+		c := &Command{ID: JobID(i), Substituted: "echo try >> " + counter + "; test $(wc -l < " + counter + ") -ge 3 || { echo flaky >&2; exit 255; }"}
+
+		tc.flags.Shell = DefaultShell
+		tc.flags.JobTimeout = time.Minute
+		tc.flags.RetryDelay = time.Millisecond
+		rules, err := parseRetryOn(tc.flags.RetryOn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		runJob(context.Background(), c, rules, tc.flags)
+
+		var got []int
+		for _, a := range c.Attempts {
+			got = append(got, a.ReturnCode)
+		}
+		if diff := cmp.Diff(tc.attempts, got); diff != "" {
+			t.Errorf("%v: attempts diff\n%s", tc.name, diff)
+		}
+		if c.Verdict != tc.verdict {
+			t.Errorf("%v: expected verdict %q, got %q", tc.name, tc.verdict, c.Verdict)
+		}
+		os.RemoveAll(c.TmpDir)
+		for _, a := range c.Attempts {
+			if kept := a.TmpDir != ""; kept != (a.ReturnCode != 0 && c.Verdict != VerdictSucceeded) {
+				t.Errorf("%v: attempt %v returned %v and the job %v, but tmpdir kept is %v", tc.name, a.Attempt, a.ReturnCode, c.Verdict, kept)
+			}
+			os.RemoveAll(a.TmpDir)
+		}
+		if len(c.Attempts) > 0 {
+			if !c.StartTime.Equal(c.Attempts[0].StartTime) {
+				t.Errorf("%v: job should start when its first attempt did", tc.name)
+			}
+			if last := c.Attempts[len(c.Attempts)-1]; last.ReturnCode != c.ReturnCode || (last.ReturnCode != 0 && tc.flags.OutputMode == "" && !cmp.Equal(last.Stderr, []string{"flaky"})) {
+				t.Errorf("%v: job should look like its last attempt: %+v", tc.name, last)
+			}
+		}
+	}
+}
+
+func Test_runJob_budget(t *testing.T) {
+
+	t.Parallel()
+
+	flags := Flags{Shell: DefaultShell, JobTimeout: time.Minute, Retries: 3, RetryDelay: time.Millisecond, MaxOutputTotal: 100}
+	ctx := withOutputBudget(context.Background(), flags)
+	c := &Command{Substituted: "echo out; echo err >&2; exit 1"}
+
+	runJob(ctx, c, retryRules{}, flags)
+	os.RemoveAll(c.TmpDir)
+	for _, a := range c.Attempts {
+		os.RemoveAll(a.TmpDir)
+	}
+
+	if len(c.Attempts) != 4 {
+		t.Fatalf("expected 4 attempts, got %v", len(c.Attempts))
+	}
+	// only the last attempt's output is still being held on to
+	if left := budgetFrom(ctx).left.Load(); left != 100-4-4 {
+		t.Errorf("expected %v left in the budget, got %v", 100-4-4, left)
+	}
+}
@@ -0,0 +1,96 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// splitCommand breaks a command up into words the way a POSIX shell would, minus all the
+// expansion: whitespace separates words, single quotes keep everything literally, double quotes
+// keep everything but backslash escapes of $ ` " \ and newline, and a backslash outside quotes
+// escapes whatever comes next.  So grep 'foo bar' file is three words, not four.
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false // so '' counts as an empty word
+
+	const (
+		none = iota
+		single
+		double
+	)
+	quote := none
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch quote {
+		case single:
+			if r == '\'' {
+				quote = none
+			} else {
+				word.WriteRune(r)
+			}
+
+		case double:
+			switch {
+			case r == '"':
+				quote = none
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]):
+				i++
+				if runes[i] != '\n' { // backslash-newline is a line continuation
+					word.WriteRune(runes[i])
+				}
+			default:
+				word.WriteRune(r)
+			}
+
+		default:
+			switch {
+			case r == ' ' || r == '\t' || r == '\n':
+				if inWord {
+					words = append(words, word.String())
+					word.Reset()
+					inWord = false
+				}
+			case r == '\'':
+				quote = single
+				inWord = true
+			case r == '"':
+				quote = double
+				inWord = true
+			case r == '\\':
+				if i+1 == len(runes) {
+					return nil, errors.New("command ends with a backslash")
+				}
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+					inWord = true
+				}
+			default:
+				word.WriteRune(r)
+				inWord = true
+			}
+		}
+	}
+
+	switch quote {
+	case single:
+		return nil, fmt.Errorf("unterminated single quote in %q", s)
+	case double:
+		return nil, fmt.Errorf("unterminated double quote in %q", s)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	return words, nil
+}
@@ -0,0 +1,174 @@
+package infra
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_splitCommand(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		command    string
+		expected   []string
+		expectPass bool
+	}{
+		{command: "echo hello", expected: []string{"echo", "hello"}, expectPass: true},
+		{command: "  echo \t hello  ", expected: []string{"echo", "hello"}, expectPass: true},
+		{command: "grep 'foo bar' file", expected: []string{"grep", "foo bar", "file"}, expectPass: true},
+		{command: `grep "foo bar" file`, expected: []string{"grep", "foo bar", "file"}, expectPass: true},
+		{command: `echo "a \"b\" \$c \n"`, expected: []string{"echo", `a "b" $c \n`}, expectPass: true},
+		{command: `echo 'it\'s'`, expectPass: false}, // no escapes inside single quotes, so this is unterminated
+		{command: `echo it\'s a\ b`, expected: []string{"echo", "it's", "a b"}, expectPass: true},
+		{command: `echo '' ""`, expected: []string{"echo", "", ""}, expectPass: true},
+		{command: `echo foo'bar'"baz"`, expected: []string{"echo", "foobarbaz"}, expectPass: true},
+		{command: `echo '$HOME'`, expected: []string{"echo", "$HOME"}, expectPass: true},
+		{command: "echo 'unterminated", expectPass: false},
+		{command: `echo "unterminated`, expectPass: false},
+		{command: `echo trailing\`, expectPass: false},
+		{command: "", expectPass: false},
+		{command: "   ", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := splitCommand(tc.command)
+
+		if tc.expectPass == false {
+			if err == nil {
+				t.Errorf("no error seen when there should be one with %q, got %q", tc.command, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.command)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%q diff\n%s", tc.command, diff)
+		}
+	}
+}
+
+func Test_executeSingleCommand_badCommand(t *testing.T) {
+
+	t.Parallel()
+
+	for _, substituted := range []string{"", "echo 'oops", "/no/such/command"} {
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		c := Command{Substituted: substituted}
+
+		executeSingleCommand(ctx, ctxCancel, &c, Flags{})
+
+		if c.Status != Errored {
+			t.Errorf("%q: status should be Errored but is instead %q", substituted, c.Status)
+		}
+		if c.ReturnCode == 0 {
+			t.Errorf("%q: return code should be non-zero", substituted)
+		}
+		if c.Error == "" {
+			t.Errorf("%q: expected an error message", substituted)
+		}
+	}
+}
+
+func Test_shellQuote(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{in: "www.mit.edu", expected: "www.mit.edu"},
+		{in: "10.0.0.1:22", expected: "10.0.0.1:22"},
+		{in: "", expected: "''"},
+		{in: "foo; rm -rf ~", expected: "'foo; rm -rf ~'"},
+		{in: "it's", expected: `'it'\''s'`},
+		{in: "$(reboot)", expected: "'$(reboot)'"},
+	}
+
+	for _, tc := range testCases {
+		if diff := cmp.Diff(tc.expected, shellQuote(tc.in)); diff != "" {
+			t.Errorf("%q diff\n%s", tc.in, diff)
+		}
+	}
+}
+
+func Test_buildListOfCommands_exec(t *testing.T) {
+
+	t.Parallel()
+
+	// no shell, but targets from find -print0 still have to come out as one word each however odd
+	// they are
+	targets := []string{"./my file.txt", "./it's.txt", `a"b\c`}
+	flags := Flags{Token: DefaultToken, NoShuffle: true, Null: true}
+	built, _, err := buildTargets(targets, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := buildListOfCommands(`printf '[%s]\n' {{1}} {{1/.}}`, built, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cl {
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		executeSingleCommand(ctx, ctxCancel, c, Flags{})
+
+		base := strings.TrimSuffix(filepath.Base(targets[i]), filepath.Ext(targets[i]))
+		want := []string{"[" + targets[i] + "]", "[" + base + "]"}
+		if diff := cmp.Diff(want, c.Stdout); diff != "" {
+			t.Errorf("%q: %v, stdout diff\n%s", targets[i], c.Error, diff)
+		}
+	}
+}
+
+func Test_buildListOfCommands_shell(t *testing.T) {
+
+	t.Parallel()
+
+	flags := Flags{Token: DefaultToken, Shell: DefaultShell, ColumnDelimiter: ","}
+	got, err := buildListOfCommands("echo {{1}} {{1|raw}} {{2/.}} {{#}}", targetsFromStrings([]string{"foo; rm -rf ~,dir/it's.txt"}), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `echo 'foo; rm -rf ~' foo; rm -rf ~ 'it'\''s' 1`
+	if diff := cmp.Diff(want, got[0].Substituted); diff != "" {
+		t.Errorf("diff\n%s", diff)
+	}
+
+	// a custom token gets quoted too
+	flags.Token = "@@@"
+	got, err = buildListOfCommands("echo @@@", targetsFromStrings([]string{"a b"}), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("echo 'a b'", got[0].Substituted); diff != "" {
+		t.Errorf("diff\n%s", diff)
+	}
+}
+
+func Test_executeSingleCommand_shell(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	c := Command{Substituted: "echo hello | tr a-z A-Z && echo 'there'"}
+
+	executeSingleCommand(ctx, ctxCancel, &c, Flags{Shell: DefaultShell})
+
+	if c.Status != Finished {
+		t.Errorf("status should be Finished but is instead %q: %v", c.Status, c.Error)
+	}
+	if diff := cmp.Diff([]string{"HELLO", "there"}, c.Stdout); diff != "" {
+		t.Errorf("stdout diff\n%s", diff)
+	}
+}
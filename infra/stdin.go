@@ -0,0 +1,71 @@
+package infra
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// newStdinRenderer renders --stdin-template for each target.  A template starting with @ is a
+// file name, e.g. @configs/{{1}}.txt, and the job reads that file.  Anything else is the stdin
+// content itself.  It's never shell quoted, since nothing's going through a shell.
+func newStdinRenderer(flags Flags) (func(d jobData) (inline string, path string, err error), error) {
+	tmpl, isFile := strings.CutPrefix(flags.StdinTemplate, "@")
+
+	render, err := newTextRenderer(tmpl, flags)
+	if err != nil {
+		return nil, fmt.Errorf("stdin template: %w", err)
+	}
+
+	return func(d jobData) (string, string, error) {
+		s, err := render(d)
+		if err != nil {
+			return "", "", fmt.Errorf("stdin template: %w", err)
+		}
+		if isFile {
+			return "", s, nil
+		}
+		// like a shell here-string, make sure the last line is a whole line
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		return s, "", nil
+	}, nil
+}
+
+// jobStdin works out what a job reads on stdin.  Files are opened rather than read in so big ones
+// are streamed to each job instead of sitting in memory.  nil means no stdin at all.  The caller
+// closes whatever comes back if it's an io.Closer.
+func jobStdin(c *Command, flags Flags) (io.Reader, error) {
+	if c.StdinData == nil && c.Stdin == "" && c.StdinFile == "" && flags.StdinFile != "" {
+		c.StdinFile = flags.StdinFile
+	}
+
+	switch {
+	case c.StdinData != nil:
+		return bytes.NewReader(c.StdinData), nil
+	case c.StdinFile != "":
+		f, err := os.Open(c.StdinFile)
+		if err != nil {
+			return nil, fmt.Errorf("stdin: %w", err)
+		}
+		return f, nil
+	case c.Stdin != "":
+		return strings.NewReader(c.Stdin), nil
+	default:
+		return nil, nil
+	}
+}
+
+func checkStdinFlags(flags Flags) error {
+	if flags.StdinFile != "" && flags.StdinTemplate != "" {
+		return errors.New("only one of --stdin-file and --stdin-template can be used")
+	}
+	if flags.StdinTemplate != "" && flags.MaxArgs > 0 {
+		return errors.New("--stdin-template can't be used with --max-args")
+	}
+	return nil
+}
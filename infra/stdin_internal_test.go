@@ -0,0 +1,61 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_stdin(t *testing.T) {
+
+	t.Parallel()
+
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared.txt")
+	if err := os.WriteFile(shared, []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "r1.cfg"), []byte("hostname r1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		flags    Flags
+		target   string
+		expected []string
+		status   JobStatus
+	}{
+		{name: "no stdin", flags: Flags{}, target: "x", expected: []string{}, status: Finished},
+		{name: "broadcast", flags: Flags{StdinFile: shared}, target: "x", expected: []string{"one", "two"}, status: Finished},
+		{name: "inline", flags: Flags{StdinTemplate: "set hostname {{1}}"}, target: "r1", expected: []string{"set hostname r1"}, status: Finished},
+		{name: "file", flags: Flags{StdinTemplate: "@" + filepath.Join(dir, "{{1}}.cfg")}, target: "r1", expected: []string{"hostname r1"}, status: Finished},
+		{name: "missing file", flags: Flags{StdinTemplate: "@" + filepath.Join(dir, "{{1}}.cfg")}, target: "r2", expected: []string{}, status: Errored},
+	}
+
+	for _, tc := range testCases {
+		tc.flags.Token = DefaultToken
+		cl, err := buildListOfCommands("cat", targetsFromStrings([]string{tc.target}), tc.flags)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		executeSingleCommand(ctx, ctxCancel, cl[0], tc.flags)
+
+		if cl[0].Status != tc.status {
+			t.Errorf("%v: expected status %v but got %v", tc.name, tc.status, cl[0].Status)
+		}
+		if diff := cmp.Diff(tc.expected, cl[0].Stdout); diff != "" {
+			t.Errorf("%v: stdout diff\n%s", tc.name, diff)
+		}
+	}
+
+	if _, err := buildListOfCommands("cat", targetsFromStrings([]string{"x"}), Flags{StdinFile: shared, StdinTemplate: "x"}); err == nil {
+		t.Error("expected an error using --stdin-file and --stdin-template together")
+	}
+}
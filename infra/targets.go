@@ -0,0 +1,315 @@
+package infra
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// target is one thing to fill a template in with.  Value is what the user gave us, Fields are the
+// columns {{1}} .. {{N}} map to and Vars are named values like {{host}}.  Fields is worked out from
+// Value with --colsep if it's left nil.
+type target struct {
+	Value  string
+	Fields []string
+	Vars   map[string]string
+}
+
+// namedList is one --list name=values
+type namedList struct {
+	Name   string
+	Values []string
+}
+
+var listNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func targetsFromStrings(ss []string) []target {
+	var ret []target
+	for _, s := range ss {
+		ret = append(ret, target{Value: s})
+	}
+	return ret
+}
+
+// buildTargets turns the targets on the command line (or stdin) plus any --list flags into the full
+// list of targets to run, along with the ones that got filtered out on the way.
+func buildTargets(args []string, flags Flags) ([]target, []FilteredTarget, error) {
+	if flags.Expand {
+		expanded, truncated, err := expandTargets(args, flags.ExpandLimit, flags.CIDRHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, t := range truncated {
+			notice(flags, "expanding %q stopped at %v targets, see --expand-limit", t, flags.ExpandLimit)
+		}
+		slog.Debug(fmt.Sprintf("buildTargets: expanded %v targets into %v", len(args), len(expanded)))
+		args = expanded
+	}
+
+	targets := targetsFromStrings(args)
+
+	// the whole point of --lines and friends is keeping targets with spaces in them in one piece,
+	// so don't split them into columns unless there's an explicit --colsep.
+	if sep, _ := inputSeparator(flags); sep != "" && flags.ColumnDelimiter == "" {
+		for i := range targets {
+			targets[i].Fields = []string{targets[i].Value}
+		}
+	}
+
+	if flags.TargetsFile != "" {
+		fileTargets, err := readTargetsFile(flags.TargetsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, fileTargets...)
+	}
+
+	targets, filtered, err := filterTargets(targets, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(flags.Lists) == 0 {
+		return targets, filtered, nil
+	}
+
+	var lists []namedList
+	for _, spec := range flags.Lists {
+		l, err := parseList(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		lists = append(lists, l)
+	}
+
+	if flags.Zip || flags.ZipShortest {
+		zipped, err := zipLists(targets, lists, flags.ColumnDelimiter, flags.ZipShortest)
+		return zipped, filtered, err
+	}
+
+	return crossProduct(targets, lists, flags.ColumnDelimiter), filtered, nil
+}
+
+// readTargetsFile reads a CSV file (TSV if the name ends in .tsv) with a header row.  Each row is a
+// target, the columns are its Fields and the header names them in Vars, so a file starting with
+// hostname,ip,site gives {{hostname}}, {{ip}} and {{site}}.
+func readTargetsFile(path string) ([]target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("targets file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	sep := ","
+	if strings.EqualFold(filepath.Ext(path), ".tsv") {
+		r.Comma = '\t'
+		sep = "\t"
+	}
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("targets file %v is empty", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("targets file %v: %w", path, err)
+	}
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+		if !listNameRE.MatchString(header[i]) {
+			slog.Warn(fmt.Sprintf("targets file %v: column %q can't be used as a {{placeholder}}", path, header[i]))
+		}
+	}
+
+	var ret []target
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("targets file %v: %w", path, err)
+		}
+
+		t := target{Value: strings.Join(row, sep), Fields: row, Vars: map[string]string{}}
+		for i, h := range header {
+			t.Vars[h] = row[i]
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// parseList parses name=a,b,c or name=@file, where the file has one value per line.
+func parseList(spec string) (namedList, error) {
+	name, values, ok := strings.Cut(spec, "=")
+	if !ok || !listNameRE.MatchString(name) {
+		return namedList{}, fmt.Errorf("invalid list %q, want name=a,b,c or name=@file", spec)
+	}
+
+	l := namedList{Name: name}
+
+	if path, isFile := strings.CutPrefix(values, "@"); isFile {
+		f, err := os.Open(path)
+		if err != nil {
+			return namedList{}, fmt.Errorf("list %v: %w", name, err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				l.Values = append(l.Values, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return namedList{}, fmt.Errorf("list %v: %w", name, err)
+		}
+	} else {
+		for _, v := range strings.Split(values, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				l.Values = append(l.Values, v)
+			}
+		}
+	}
+
+	if len(l.Values) == 0 {
+		return namedList{}, fmt.Errorf("list %v is empty", name)
+	}
+
+	return l, nil
+}
+
+// crossProduct makes one target for every combination of the plain targets (if there are any) and
+// every value of every list.  The last list changes fastest.  Fields are the plain target's columns
+// followed by the list values in the order the lists were given, so {{1}} still means something
+// when there are only lists.
+func crossProduct(targets []target, lists []namedList, delimiter string) []target {
+	haveTargets := len(targets) > 0
+	if !haveTargets {
+		targets = []target{{Fields: []string{}}}
+	}
+
+	total := len(targets)
+	var sizes []string
+	if haveTargets {
+		sizes = append(sizes, fmt.Sprintf("targets(%v)", len(targets)))
+	}
+	for _, l := range lists {
+		total *= len(l.Values)
+		sizes = append(sizes, fmt.Sprintf("%v(%v)", l.Name, len(l.Values)))
+	}
+	slog.Debug(fmt.Sprintf("crossProduct: %v = %v", strings.Join(sizes, " x "), total))
+
+	ret := make([]target, 0, total)
+	for _, t := range targets {
+		fields := t.Fields
+		if fields == nil {
+			fields = splitTarget(t.Value, delimiter)
+		}
+
+		// odometer over the lists, idx[i] is which value of lists[i] we're on
+		idx := make([]int, len(lists))
+		for {
+			n := target{Value: t.Value, Vars: map[string]string{}}
+			maps.Copy(n.Vars, t.Vars)
+			n.Fields = append(n.Fields, fields...)
+			var values []string
+			for i, l := range lists {
+				v := l.Values[idx[i]]
+				n.Vars[l.Name] = v
+				n.Fields = append(n.Fields, v)
+				values = append(values, v)
+			}
+			if !haveTargets {
+				n.Value = strings.Join(values, " ")
+			}
+			ret = append(ret, n)
+
+			i := len(idx) - 1
+			for ; i >= 0; i-- {
+				idx[i]++
+				if idx[i] < len(lists[i].Values) {
+					break
+				}
+				idx[i] = 0
+			}
+			if i < 0 {
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+// zipLists pairs the lists up element by element instead of taking every combination: item i of
+// every list goes into target i.  Plain targets, if there are any, are one more list and come first.
+// Lists of different lengths are an error unless shortest is set, in which case everything is cut
+// down to the length of the shortest list.
+func zipLists(targets []target, lists []namedList, delimiter string, shortest bool) ([]target, error) {
+	haveTargets := len(targets) > 0
+
+	var lengths []string
+	n := -1
+	mismatch := false
+	check := func(name string, l int) {
+		lengths = append(lengths, fmt.Sprintf("%v(%v)", name, l))
+		if n != -1 && l != n {
+			mismatch = true
+		}
+		if n == -1 || l < n {
+			n = l
+		}
+	}
+
+	if haveTargets {
+		check("targets", len(targets))
+	}
+	for _, l := range lists {
+		check(l.Name, len(l.Values))
+	}
+
+	if mismatch && !shortest {
+		return nil, fmt.Errorf("can't zip lists of different lengths: %v", strings.Join(lengths, " "))
+	}
+	slog.Debug(fmt.Sprintf("zipLists: %v = %v", strings.Join(lengths, " "), n))
+
+	ret := make([]target, 0, n)
+	for i := 0; i < n; i++ {
+		t := target{Vars: map[string]string{}, Fields: []string{}}
+		if haveTargets {
+			t.Value = targets[i].Value
+			t.Fields = append(t.Fields, targets[i].Fields...)
+			if targets[i].Fields == nil {
+				t.Fields = splitTarget(t.Value, delimiter)
+			}
+			maps.Copy(t.Vars, targets[i].Vars)
+		}
+
+		var values []string
+		for _, l := range lists {
+			v := l.Values[i]
+			t.Vars[l.Name] = v
+			t.Fields = append(t.Fields, v)
+			values = append(values, v)
+		}
+		if !haveTargets {
+			t.Value = strings.Join(values, " ")
+		}
+
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
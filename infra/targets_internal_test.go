@@ -0,0 +1,254 @@
+package infra
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_parseList(t *testing.T) {
+
+	t.Parallel()
+
+	hostFile := filepath.Join(t.TempDir(), "hosts.txt")
+	if err := os.WriteFile(hostFile, []byte("r1\n\nr2\n  r3  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		spec       string
+		expected   namedList
+		expectPass bool
+	}{
+		{spec: "port=22,80, 443", expected: namedList{Name: "port", Values: []string{"22", "80", "443"}}, expectPass: true},
+		{spec: "host=@" + hostFile, expected: namedList{Name: "host", Values: []string{"r1", "r2", "r3"}}, expectPass: true},
+		{spec: "host=@/no/such/file", expectPass: false},
+		{spec: "nope", expectPass: false},
+		{spec: "1host=a", expectPass: false},
+		{spec: "host=", expectPass: false},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseList(tc.spec)
+
+		if tc.expectPass == false {
+			if err == nil {
+				t.Errorf("no error seen when there should be one with %q", tc.spec)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error %q when there should be none with %q", err, tc.spec)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.expected, got); diff != "" {
+			t.Errorf("diff\n%s", diff)
+		}
+	}
+}
+
+func Test_crossProduct(t *testing.T) {
+
+	t.Parallel()
+
+	lists := []namedList{
+		{Name: "host", Values: []string{"r1", "r2"}},
+		{Name: "port", Values: []string{"22", "80"}},
+	}
+
+	got := crossProduct(nil, lists, "")
+	want := []target{
+		{Value: "r1 22", Fields: []string{"r1", "22"}, Vars: map[string]string{"host": "r1", "port": "22"}},
+		{Value: "r1 80", Fields: []string{"r1", "80"}, Vars: map[string]string{"host": "r1", "port": "80"}},
+		{Value: "r2 22", Fields: []string{"r2", "22"}, Vars: map[string]string{"host": "r2", "port": "22"}},
+		{Value: "r2 80", Fields: []string{"r2", "80"}, Vars: map[string]string{"host": "r2", "port": "80"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lists only diff\n%s", diff)
+	}
+
+	// plain targets are one more dimension, and come first in Fields
+	got = crossProduct(targetsFromStrings([]string{"a b", "c"}), lists[1:], "")
+	want = []target{
+		{Value: "a b", Fields: []string{"a", "b", "22"}, Vars: map[string]string{"port": "22"}},
+		{Value: "a b", Fields: []string{"a", "b", "80"}, Vars: map[string]string{"port": "80"}},
+		{Value: "c", Fields: []string{"c", "22"}, Vars: map[string]string{"port": "22"}},
+		{Value: "c", Fields: []string{"c", "80"}, Vars: map[string]string{"port": "80"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("targets and lists diff\n%s", diff)
+	}
+}
+
+func Test_buildListOfCommands_named(t *testing.T) {
+
+	t.Parallel()
+
+	flags := Flags{Token: DefaultToken, Lists: []string{"host=r1,r2", "port=22,80,443"}}
+
+	targets, _, err := buildTargets(nil, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := buildListOfCommands("nc -z {{host}} {{port}}", targets, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 6 {
+		t.Errorf("expected 6 commands, got %v", len(got))
+	}
+
+	for _, c := range got {
+		want := "nc -z " + c.Vars["host"] + " " + c.Vars["port"]
+		if c.Substituted != want {
+			t.Errorf("expected %q but got %q", want, c.Substituted)
+		}
+	}
+
+	if _, err := buildListOfCommands("nc -z {{hots}}", targets, flags); err == nil {
+		t.Error("expected an error for an unknown name")
+	}
+}
+
+func Test_zipLists(t *testing.T) {
+
+	t.Parallel()
+
+	devices := namedList{Name: "dev", Values: []string{"r1", "r2", "r3"}}
+	ips := namedList{Name: "ip", Values: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}
+	short := namedList{Name: "site", Values: []string{"dc1", "dc2"}}
+
+	got, err := zipLists(nil, []namedList{devices, ips}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []target{
+		{Value: "r1 10.0.0.1", Fields: []string{"r1", "10.0.0.1"}, Vars: map[string]string{"dev": "r1", "ip": "10.0.0.1"}},
+		{Value: "r2 10.0.0.2", Fields: []string{"r2", "10.0.0.2"}, Vars: map[string]string{"dev": "r2", "ip": "10.0.0.2"}},
+		{Value: "r3 10.0.0.3", Fields: []string{"r3", "10.0.0.3"}, Vars: map[string]string{"dev": "r3", "ip": "10.0.0.3"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("zip diff\n%s", diff)
+	}
+
+	// plain targets are zipped in too
+	got, err = zipLists(targetsFromStrings([]string{"a", "b"}), []namedList{short}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []target{
+		{Value: "a", Fields: []string{"a", "dc1"}, Vars: map[string]string{"site": "dc1"}},
+		{Value: "b", Fields: []string{"b", "dc2"}, Vars: map[string]string{"site": "dc2"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("zip with targets diff\n%s", diff)
+	}
+
+	if _, err := zipLists(nil, []namedList{devices, short}, "", false); err == nil {
+		t.Error("expected an error zipping lists of different lengths")
+	}
+
+	got, err = zipLists(nil, []namedList{devices, short}, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected zip-shortest to give 2 targets, got %v", len(got))
+	}
+}
+
+func Test_readTargetsFile(t *testing.T) {
+
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	csvFile := write("inventory.csv", "hostname,ip,site,model\nr1,10.0.0.1,dc1,mx480\n# r2 is in maintenance\nr3, 10.0.0.3,dc2,\"mx 960\"\n")
+	tsvFile := write("inventory.tsv", "hostname\tip\nr1\t10.0.0.1\n")
+	raggedFile := write("ragged.csv", "hostname,ip\nr1\n")
+	emptyFile := write("empty.csv", "")
+
+	got, err := readTargetsFile(csvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []target{
+		{
+			Value:  "r1,10.0.0.1,dc1,mx480",
+			Fields: []string{"r1", "10.0.0.1", "dc1", "mx480"},
+			Vars:   map[string]string{"hostname": "r1", "ip": "10.0.0.1", "site": "dc1", "model": "mx480"},
+		},
+		{
+			Value:  "r3,10.0.0.3,dc2,mx 960",
+			Fields: []string{"r3", "10.0.0.3", "dc2", "mx 960"},
+			Vars:   map[string]string{"hostname": "r3", "ip": "10.0.0.3", "site": "dc2", "model": "mx 960"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("csv diff\n%s", diff)
+	}
+
+	got, err = readTargetsFile(tsvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"hostname": "r1", "ip": "10.0.0.1"}, got[0].Vars); diff != "" {
+		t.Errorf("tsv diff\n%s", diff)
+	}
+
+	for _, bad := range []string{raggedFile, emptyFile, filepath.Join(dir, "nope.csv")} {
+		if _, err := readTargetsFile(bad); err == nil {
+			t.Errorf("expected an error reading %v", bad)
+		}
+	}
+
+	// a list on top of a targets file keeps the file's vars
+	targets, _, err := buildTargets(nil, Flags{TargetsFile: tsvFile, Lists: []string{"port=22,80"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := buildListOfCommands("nc -z {{ip}} {{port}} # {{hostname}}", targets, Flags{Token: DefaultToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		if want := "nc -z 10.0.0.1 " + c.Vars["port"] + " # r1"; c.Substituted != want {
+			t.Errorf("expected %q but got %q", want, c.Substituted)
+		}
+	}
+}
+
+func Test_buildTargets_lines(t *testing.T) {
+
+	t.Parallel()
+
+	// with --lines a target is one column unless there's a --colsep
+	got, _, err := buildTargets([]string{"my file.txt"}, Flags{Lines: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"my file.txt"}, got[0].Fields); diff != "" {
+		t.Errorf("diff\n%s", diff)
+	}
+
+	got, _, err = buildTargets([]string{"fw.bin r1"}, Flags{Lines: true, ColumnDelimiter: " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Fields != nil {
+		t.Errorf("expected fields to be left for --colsep to split, got %q", got[0].Fields)
+	}
+}
@@ -0,0 +1,66 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newWorkdirRenderer renders --workdir for each job.  It returns nil if there's no --workdir.
+func newWorkdirRenderer(flags Flags) (renderFunc, error) {
+	if flags.Workdir == "" {
+		return nil, nil
+	}
+
+	render, err := newTextRenderer(flags.Workdir, flags)
+	if err != nil {
+		return nil, fmt.Errorf("workdir: %w", err)
+	}
+
+	return func(d jobData) (string, error) {
+		dir, err := render(d)
+		if err != nil {
+			return "", fmt.Errorf("workdir: %w", err)
+		}
+		return dir, nil
+	}, nil
+}
+
+// jobDirs makes a job its own scratch directory, fills in {{tmpdir}} and CONCUR_TMPDIR, and
+// creates its working directory if it doesn't exist yet.  The cleanup function removes the
+// scratch directory once the job's done unless it failed or --keep-tmp is set, in which case the
+// job's tmpdir says where it is.
+func jobDirs(c *Command, flags Flags) (cleanup func(), err error) {
+	tmp, err := os.MkdirTemp("", "concur-")
+	if err != nil {
+		return nil, fmt.Errorf("tmpdir: %w", err)
+	}
+
+	c.Substituted = strings.ReplaceAll(c.Substituted, TmpdirToken, shellQuote(tmp))
+	c.Dir = strings.ReplaceAll(c.Dir, TmpdirToken, tmp)
+
+	if c.EnvVars == nil {
+		c.EnvVars = map[string]string{}
+	}
+	for k, v := range c.EnvVars {
+		c.EnvVars[k] = strings.ReplaceAll(v, TmpdirToken, tmp)
+	}
+	if _, ok := c.EnvVars["CONCUR_TMPDIR"]; !ok {
+		c.EnvVars["CONCUR_TMPDIR"] = tmp
+	}
+
+	if c.Dir != "" {
+		if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+			os.RemoveAll(tmp)
+			return nil, fmt.Errorf("workdir: %w", err)
+		}
+	}
+
+	return func() {
+		if flags.KeepTmp || c.Status != Finished || c.ReturnCode != 0 {
+			c.TmpDir = tmp
+			return
+		}
+		os.RemoveAll(tmp)
+	}, nil
+}
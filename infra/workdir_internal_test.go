@@ -0,0 +1,61 @@
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_workdir(t *testing.T) {
+
+	t.Parallel()
+
+	dir := t.TempDir()
+	flags := Flags{Token: DefaultToken, Shell: DefaultShell, Workdir: filepath.Join(dir, "runs", "{{1}}")}
+
+	cl, err := buildListOfCommands("touch out.txt; echo {{tmpdir}} $CONCUR_TMPDIR; test -d {{tmpdir}}", targetsFromStrings([]string{"r1"}), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cl[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	executeSingleCommand(ctx, cancel, c, flags)
+
+	if c.Status != Finished {
+		t.Fatalf("expected status %v but got %v: %q", Finished, c.Status, c.Stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "runs", "r1", "out.txt")); err != nil {
+		t.Errorf("job didn't run in its workdir: %v", err)
+	}
+
+	tmps := strings.Fields(c.Stdout[0])
+	if len(tmps) != 2 || tmps[0] != tmps[1] || !strings.Contains(tmps[0], "concur-") {
+		t.Fatalf("{{tmpdir}} and CONCUR_TMPDIR should be the same scratch dir: %q", c.Stdout[0])
+	}
+	if _, err := os.Stat(tmps[0]); !os.IsNotExist(err) {
+		t.Errorf("tmpdir %v should have been removed", tmps[0])
+	}
+	if c.TmpDir != "" {
+		t.Errorf("tmpdir %v was removed so it shouldn't be in the results", c.TmpDir)
+	}
+
+	// failed jobs keep theirs so there's something to look at
+	cl, err = buildListOfCommands("/bin/sh -c 'touch $CONCUR_TMPDIR/debug.log; exit 1'", targetsFromStrings([]string{"r2"}), Flags{Token: DefaultToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = cl[0]
+	ctx, cancel = context.WithCancel(context.Background())
+	executeSingleCommand(ctx, cancel, c, Flags{})
+
+	if c.TmpDir == "" {
+		t.Fatal("a failed job's tmpdir should be kept")
+	}
+	if _, err := os.Stat(filepath.Join(c.TmpDir, "debug.log")); err != nil {
+		t.Errorf("failed job's tmpdir is missing: %v", err)
+	}
+	os.RemoveAll(c.TmpDir)
+}